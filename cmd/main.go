@@ -27,6 +27,11 @@ var (
 		LeaderHelper   leaderelect.Helper
 		ResyncDuration time.Duration
 		ListenAddr     string
+		AdminAddr      string
+		Output         string
+		WatchImports   bool
+		StatusInterval time.Duration
+		Events         bool
 	}{}
 )
 
@@ -45,7 +50,23 @@ func runApplication(args []string) error {
 		labelSelector, annotationSources, annotationProbes := fmt.Sprintf("%s%s=%s", globalOptions.Prefix, "importer", globalOptions.Importer),
 			fmt.Sprintf("%s%s", globalOptions.Prefix, "sources"),
 			fmt.Sprintf("%s%s", globalOptions.Prefix, "probes")
-		controller.StartEndpointsImporter(ctx, globalOptions.KubeClient, labelSelector, annotationSources, annotationProbes, globalOptions.ResyncDuration, globalOptions.ListenAddr)
+		if _, err := controller.StartEndpointsImporter(ctx, globalOptions.KubeClient, controller.ImporterOpts{
+			LabelSelector:     labelSelector,
+			AnnotationSources: annotationSources,
+			AnnotationProbes:  annotationProbes,
+			Resync:            globalOptions.ResyncDuration,
+			Server:            globalOptions.ListenAddr,
+			AdminServer:       globalOptions.AdminAddr,
+			Output:            controller.OutputMode(globalOptions.Output),
+			WatchImports:      globalOptions.WatchImports,
+			AnnotationStatus:  fmt.Sprintf("%s%s", globalOptions.Prefix, "status"),
+			AnnotationDrain:   fmt.Sprintf("%s%s", globalOptions.Prefix, "drain"),
+			AnnotationService: fmt.Sprintf("%s%s", globalOptions.Prefix, "service"),
+			StatusInterval:    globalOptions.StatusInterval,
+			Events:            globalOptions.Events,
+		}); err != nil {
+			globalOptions.Logger.Printf("importer: %v", err)
+		}
 	})
 	<-application.Context().Done()
 	return nil
@@ -70,7 +91,12 @@ func main() {
 	flags.StringVar(&globalOptions.Importer, "importer", "", "importer profile(watch label value)")
 	flags.StringVarP(&globalOptions.Prefix, "prefix", "p", "kube-service-importer.xiaopal.github.com/", "watch label/annotations prefix")
 	flags.DurationVar(&globalOptions.ResyncDuration, "resync", 0, "resync period")
-	flags.StringVar(&globalOptions.ListenAddr, "listen", "", "start http server to handle /health and /endpoints, eg. :8080")
+	flags.StringVar(&globalOptions.ListenAddr, "listen", "", "start http server to handle /health, /endpoints and /metrics, eg. :8080")
+	flags.StringVar(&globalOptions.AdminAddr, "admin-listen", "", "start unauthenticated admin http server to handle /drain, disabled by default, eg. 127.0.0.1:8081")
+	flags.StringVar(&globalOptions.Output, "output", string(controller.OutputEndpoints), "write imported addresses to endpoints, endpointslices or both")
+	flags.BoolVar(&globalOptions.WatchImports, "crd", false, "also watch ExternalServiceImport resources (CRD must be installed)")
+	flags.DurationVar(&globalOptions.StatusInterval, "status-interval", 30*time.Second, "minimum interval between status annotation updates, 0 to disable")
+	flags.BoolVar(&globalOptions.Events, "events", true, "record events for health transitions and source failures")
 	globalOptions.Logger, globalOptions.KubeClient, globalOptions.LeaderHelper = logger, kubeClient, leaderHelper
 	if err := cmd.Execute(); err != nil {
 		logger.Fatal(err)
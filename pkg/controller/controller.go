@@ -6,6 +6,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
@@ -26,44 +27,97 @@ import (
 // EndpointsImporter interface
 type EndpointsImporter interface{}
 
+// OutputMode type
+type OutputMode string
+
+const (
+	// OutputEndpoints patch v1/Endpoints only
+	OutputEndpoints OutputMode = "endpoints"
+	// OutputEndpointSlices write discovery.k8s.io/v1 EndpointSlices only
+	OutputEndpointSlices OutputMode = "endpointslices"
+	// OutputBoth patch v1/Endpoints and write EndpointSlices
+	OutputBoth OutputMode = "both"
+)
+
+// Endpoints returns whether v1/Endpoints should be patched
+func (m OutputMode) Endpoints() bool {
+	return m == OutputEndpoints || m == OutputBoth
+}
+
+// EndpointSlices returns whether EndpointSlices should be written
+func (m OutputMode) EndpointSlices() bool {
+	return m == OutputEndpointSlices || m == OutputBoth
+}
+
+// ImporterOpts type
+type ImporterOpts struct {
+	LabelSelector     string
+	AnnotationSources string
+	AnnotationProbes  string
+	Resync            time.Duration
+	Server            string
+	AdminServer       string
+	Output            OutputMode
+	WatchImports      bool
+	AnnotationStatus  string
+	AnnotationDrain   string
+	AnnotationService string
+	StatusInterval    time.Duration
+	Events            bool
+}
+
 type endpointsImporter struct {
-	ctx                                 context.Context
-	statusUpdater                       prober.StatusUpdater
-	kubeClient                          kubeclient.Client
-	client                              dynamic.Interface
-	resource                            *metav1.APIResource
-	labelSelector                       string
-	annotationSources, annotationProbes string
-	logger                              *log.Logger
-	informer                            informer.Informer
-	targets                             map[objectKey]*targetRecord
-	updateQueue                         workqueue.RateLimitingInterface
+	sync.Mutex
+	ImporterOpts
+	ctx             context.Context
+	statusUpdater   prober.StatusUpdater
+	kubeClient      kubeclient.Client
+	client          dynamic.Interface
+	resource        *metav1.APIResource
+	sliceClient     dynamic.Interface
+	sliceResource   *metav1.APIResource
+	importClient    dynamic.Interface
+	importResource  *metav1.APIResource
+	secretClient    dynamic.Interface
+	secretResource  *metav1.APIResource
+	probeSecrets    probeSecretCache
+	serviceClient   dynamic.Interface
+	serviceResource *metav1.APIResource
+	serviceWatch    int
+	logger          *log.Logger
+	informer        informer.Informer
+	targets         map[objectKey]*targetRecord
+	updateQueue     workqueue.RateLimitingInterface
+	events          *eventRecorder
+	metrics         *importerMetrics
 }
 
 // StartEndpointsImporter func
-func StartEndpointsImporter(ctx context.Context, kubeClient kubeclient.Client,
-	labelSelector string,
-	annotationSources, annotationProbes string,
-	resync time.Duration,
-	server string) (controller EndpointsImporter, err error) {
-	if labelSelector == "" {
+func StartEndpointsImporter(ctx context.Context, kubeClient kubeclient.Client, opts ImporterOpts) (controller EndpointsImporter, err error) {
+	if opts.LabelSelector == "" {
 		return nil, fmt.Errorf("labelSelector required")
 	}
-	if annotationProbes == "" {
+	if opts.AnnotationProbes == "" {
 		return nil, fmt.Errorf("annotationProbes required")
 	}
+	switch opts.Output {
+	case "":
+		opts.Output = OutputEndpoints
+	case OutputEndpoints, OutputEndpointSlices, OutputBoth:
+	default:
+		return nil, fmt.Errorf("illegal output mode: %v", opts.Output)
+	}
 	logger := log.New(os.Stderr, "[importer] ", log.Flags())
 	c := &endpointsImporter{
-		ctx:               ctx,
-		statusUpdater:     prober.NewStatusUpdater(ctx, logger),
-		kubeClient:        kubeClient,
-		labelSelector:     labelSelector,
-		annotationSources: annotationSources,
-		annotationProbes:  annotationProbes,
-		logger:            logger,
-		targets:           map[objectKey]*targetRecord{},
-		updateQueue:       workqueue.NewRateLimitingQueue(informer.DefaultRateLimiter(5*time.Millisecond, 1000*time.Second, math.MaxFloat64, math.MaxInt32)),
+		ImporterOpts:  opts,
+		ctx:           ctx,
+		statusUpdater: prober.NewStatusUpdater(ctx, logger),
+		kubeClient:    kubeClient,
+		logger:        logger,
+		targets:       map[objectKey]*targetRecord{},
+		updateQueue:   workqueue.NewRateLimitingQueue(informer.DefaultRateLimiter(5*time.Millisecond, 1000*time.Second, math.MaxFloat64, math.MaxInt32)),
 	}
+	c.metrics = newImporterMetrics(c)
 	c.informer = informer.NewInformer(kubeClient, informer.Opts{
 		Logger:     logger,
 		MaxRetries: -1,
@@ -74,13 +128,46 @@ func StartEndpointsImporter(ctx context.Context, kubeClient kubeclient.Client,
 	if c.client, c.resource, err = c.kubeClient.DynamicClient("v1", "Endpoints"); err != nil {
 		return nil, err
 	}
-	c.informer.Watch("v1", "Endpoints", kubeClient.Namespace(), labelSelector, "", 1800*time.Second)
+	if c.secretClient, c.secretResource, err = c.kubeClient.DynamicClient("v1", "Secret"); err != nil {
+		return nil, err
+	}
+	if c.serviceClient, c.serviceResource, err = c.kubeClient.DynamicClient("v1", "Service"); err != nil {
+		return nil, err
+	}
+	if c.Events {
+		eventClient, eventResource, err := c.kubeClient.DynamicClient("v1", "Event")
+		if err != nil {
+			return nil, err
+		}
+		c.events = newEventRecorder(ctx, eventClient, eventResource, logger)
+	}
+	if c.Output.EndpointSlices() {
+		if c.sliceClient, c.sliceResource, err = c.kubeClient.DynamicClient("discovery.k8s.io/v1", "EndpointSlice"); err != nil {
+			return nil, err
+		}
+	}
+	c.informer.Watch("v1", "Endpoints", kubeClient.Namespace(), c.LabelSelector, "", 1800*time.Second)
+	// generated Services are labelled like the Endpoints, and only Services matching the selector are managed
+	c.serviceWatch = 1
+	c.informer.Watch("v1", "Service", kubeClient.Namespace(), c.LabelSelector, "", 1800*time.Second)
+	if c.WatchImports {
+		if c.importClient, c.importResource, err = c.kubeClient.DynamicClient(ImportAPIVersion, ImportKind); err != nil {
+			return nil, err
+		}
+		c.informer.Watch(ImportAPIVersion, ImportKind, kubeClient.Namespace(), c.LabelSelector, "", 1800*time.Second)
+	}
 	go wait.Until(func() {
 		for c.processUpdates(ctx) {
 		}
 	}, time.Second, ctx.Done())
-	if server != "" {
-		c.informer.EnableIndexServerWithLocations(server, informer.IndexServerLocations{Health: "/health", Default: "/endpoints"})
+	if c.Server != "" {
+		mux := c.informer.EnableIndexServerWithLocations(c.Server, informer.IndexServerLocations{Health: "/health", Default: "/endpoints"})
+		mux.Handle("/metrics", c.metrics.handler())
+	}
+	if c.AdminServer != "" {
+		if err := c.startAdminServer(ctx); err != nil {
+			return nil, err
+		}
 	}
 	return c, c.informer.Run(ctx)
 }
@@ -91,31 +178,43 @@ func toEndpoints(obj *unstructured.Unstructured) (*corev1.Endpoints, error) {
 }
 
 func (c *endpointsImporter) handleEvent(ctx context.Context, event informer.EventType, obj *unstructured.Unstructured) error {
+	switch obj.GetKind() {
+	case ImportKind:
+		return c.handleImportEvent(event, obj)
+	case "Service":
+		return c.handleServiceEvent(event, obj)
+	}
 	endpoints, err := toEndpoints(obj)
 	if err != nil {
 		return err
 	}
+	c.Lock()
+	defer c.Unlock()
 	switch event {
 	case informer.EventAdd, informer.EventUpdate:
 		probeConfs, sourceConfs, annotationProbes, annotationSources := []fluconf.Config{}, []fluconf.Config{},
-			obj.GetAnnotations()[c.annotationProbes], obj.GetAnnotations()[c.annotationSources]
+			obj.GetAnnotations()[c.AnnotationProbes], obj.GetAnnotations()[c.AnnotationSources]
+		// options preceding the first probe, eg. health-scope=host, are also kept in probeOpts
+		probeOpts := fluconf.Config{
+			"interval": "5s",
+			"timeout":  "5s",
+			"fall":     "3",
+			"rise":     "3",
+		}
 		if annotationProbes != "" {
-			probeConfs = fluconf.Parse(annotationProbes, "probe", fluconf.Config{
-				"interval": "5s",
-				"timeout":  "5s",
-				"fall":     "3",
-				"rise":     "3",
-			})
+			probeConfs = fluconf.Parse(annotationProbes, "probe", probeOpts, "header")
+		}
+		drains, err := parseDrains(obj.GetAnnotations()[c.AnnotationDrain])
+		if err != nil {
+			c.events.Event(objectKey{endpoints.Namespace, endpoints.Name}, endpoints.UID, corev1.EventTypeWarning, EventInvalidDrain, fmt.Sprintf("drain: %v", err))
 		}
 		if annotationSources != "" {
-			sourceConfs = fluconf.Parse(annotationSources, "source", fluconf.Config{
-				"interval": "30s",
-				"timeout":  "30s",
-			})
+			// intervals and timeouts default by source type, see source.SourceDefaults
+			sourceConfs = fluconf.Parse(annotationSources, "source", nil, "header", "tag")
 		}
-		return c.updateTarget(endpoints, probeConfs, sourceConfs)
+		return c.updateTarget(endpoints, probeOpts, probeConfs, sourceConfs, drains)
 	case informer.EventDelete:
-		return c.updateTarget(endpoints, []fluconf.Config{}, []fluconf.Config{})
+		return c.updateTarget(endpoints, fluconf.Config{}, []fluconf.Config{}, []fluconf.Config{}, nil)
 	}
 	return nil
 }
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-informer/pkg/informer"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_endpointsImporter_handleEvent_sourceDefaults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &endpointsImporter{
+		ImporterOpts:  ImporterOpts{AnnotationProbes: "probes", AnnotationSources: "sources", Output: OutputEndpoints},
+		statusUpdater: prober.NewStatusUpdater(ctx, log.New(ioutil.Discard, "", 0)),
+		logger:        log.New(ioutil.Discard, "", 0),
+		targets:       map[objectKey]*targetRecord{},
+		updateQueue:   workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.updateQueue.ShutDown()
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Endpoints")
+	obj.SetNamespace("default")
+	obj.SetName("test")
+	obj.SetAnnotations(map[string]string{"sources": "consul url=http://127.0.0.1:1 service=web\n" +
+		"consul url=http://127.0.0.1:1 service=api interval=2s\n" +
+		"static ip=10.0.0.1 port=80"})
+	if err := c.handleEvent(ctx, informer.EventAdd, obj); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]time.Duration{
+		"web":    {time.Second, 6 * time.Minute},
+		"api":    {2 * time.Second, 6 * time.Minute},
+		"static": {30 * time.Second, 30 * time.Second},
+	}
+	target := c.targets[objectKey{"default", "test"}]
+	if target == nil || len(target.sources) != len(want) {
+		t.Fatalf("sources of handleEvent() = %v", target)
+	}
+	for key, source := range target.sources {
+		for name, durations := range want {
+			if strings.Contains(key.source, name) {
+				if got := [2]time.Duration{source.Interval(), source.Timeout()}; got != durations {
+					t.Errorf("interval and timeout of %s = %v, want %v", key.source, got, durations)
+				}
+			}
+		}
+	}
+}
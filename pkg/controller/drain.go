@@ -0,0 +1,258 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ptypes "k8s.io/apimachinery/pkg/types"
+)
+
+// drain takes an address out of rotation regardless of probes, until it expires
+type drain struct {
+	remove bool
+	until  time.Time
+}
+
+func (d drain) active(now time.Time) bool {
+	return d.until.IsZero() || now.Before(d.until)
+}
+
+func (d drain) record() drainStatusRecord {
+	return drainStatusRecord{Remove: d.remove, Until: metaTime(d.until)}
+}
+
+// parseDrains parses the drain annotation, eg. `10.0.0.5,10.0.0.6 until=2006-01-02T15:04:05Z 10.0.0.7 remove=yes`,
+// illegal entries are skipped and the first error returned
+func parseDrains(annotation string) (map[string]drain, error) {
+	drains, firstErr := map[string]drain{}, error(nil)
+	for _, conf := range fluconf.Parse(annotation, "ip", nil) {
+		d, err := drain{remove: conf.GetBool("remove", false)}, error(nil)
+		if until, ok := conf["until"]; ok {
+			if d.until, err = time.Parse(time.RFC3339, until); err != nil {
+				err = fmt.Errorf("illegal until %q", until)
+			}
+		}
+		ips := strings.Split(conf["ip"], ",")
+		for _, ip := range ips {
+			if err == nil && net.ParseIP(strings.TrimSpace(ip)) == nil {
+				err = fmt.Errorf("illegal ip %q", ip)
+			}
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, ip := range ips {
+			drains[strings.TrimSpace(ip)] = d
+		}
+	}
+	return drains, firstErr
+}
+
+// formatDrains is the reverse of parseDrains
+func formatDrains(drains map[string]drain) string {
+	ips := make([]string, 0, len(drains))
+	for ip := range drains {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	entries := make([]fluconf.Config, len(ips))
+	for i, ip := range ips {
+		entries[i] = fluconf.Config{"ip": ip}
+		if drains[ip].remove {
+			entries[i]["remove"] = "yes"
+		}
+		if !drains[ip].until.IsZero() {
+			entries[i]["until"] = drains[ip].until.UTC().Format(time.RFC3339)
+		}
+	}
+	return fluconf.Format(entries, "ip")
+}
+
+func (h *targetRecord) activeDrains(now time.Time) map[string]drain {
+	drains := map[string]drain{}
+	for ip, d := range h.drains {
+		if d.active(now) {
+			drains[ip] = d
+		}
+	}
+	return drains
+}
+
+// drainRequest is a change of drains, parsed from ?namespace=&name=&ip=[,ip][&ttl=10m|&until=RFC3339][&remove=yes]
+type drainRequest struct {
+	namespace, name string
+	ips             []string
+	drain           drain
+}
+
+func parseDrainRequest(req *http.Request, now time.Time) (*drainRequest, error) {
+	query := req.URL.Query()
+	dreq := &drainRequest{namespace: query.Get("namespace"), name: query.Get("name")}
+	if dreq.namespace == "" || dreq.name == "" || query.Get("ip") == "" {
+		return nil, fmt.Errorf("namespace, name and ip required")
+	}
+	for _, ip := range strings.Split(query.Get("ip"), ",") {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("illegal ip %q", ip)
+		}
+		dreq.ips = append(dreq.ips, ip)
+	}
+	conf := fluconf.Config{}
+	for key := range query {
+		conf[key] = query.Get(key)
+	}
+	dreq.drain.remove = conf.GetBool("remove", false)
+	switch ttl, until := conf["ttl"], conf["until"]; {
+	case ttl != "":
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("illegal ttl %q", ttl)
+		}
+		dreq.drain.until = now.Add(duration)
+	case until != "":
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, fmt.Errorf("illegal until %q", until)
+		}
+		dreq.drain.until = t
+	}
+	return dreq, nil
+}
+
+// startAdminServer serves the admin endpoints on AdminServer until ctx is done; they are kept off the Server
+// address, as /drain edits annotations without authentication and /health or /metrics are commonly exposed
+func (c *endpointsImporter) startAdminServer(ctx context.Context) error {
+	listener, err := net.Listen("tcp", c.AdminServer)
+	if err != nil {
+		return fmt.Errorf("admin server: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/drain", c.serveDrain)
+	server := &http.Server{Addr: c.AdminServer, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			c.logger.Printf("failed to close admin server: %v", err)
+		}
+	}()
+	go func() {
+		c.logger.Printf("serving admin on %s ...", c.AdminServer)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			c.logger.Printf("admin server exited: %v", err)
+		}
+	}()
+	return nil
+}
+
+// serveDrain is the admin endpoint of drains: GET lists active drains, POST drains addresses and DELETE undrains them;
+// changes are written to the drain annotation of Endpoints matching the label selector, see drainRequest
+func (c *endpointsImporter) serveDrain(res http.ResponseWriter, req *http.Request) {
+	writeJSON := func(code int, val interface{}) {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(code)
+		json.NewEncoder(res).Encode(val)
+	}
+	writeError := func(code int, err error) {
+		writeJSON(code, map[string]string{"error": err.Error()})
+	}
+	now := time.Now()
+	switch req.Method {
+	case http.MethodGet:
+		c.Lock()
+		defer c.Unlock()
+		drains := map[string]map[string]drainStatusRecord{}
+		for key, target := range c.targets {
+			for ip, d := range target.activeDrains(now) {
+				name := key.namespace + "/" + key.name
+				if drains[name] == nil {
+					drains[name] = map[string]drainStatusRecord{}
+				}
+				drains[name][ip] = d.record()
+			}
+		}
+		writeJSON(http.StatusOK, drains)
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		writeError(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	dreq, err := parseDrainRequest(req, now)
+	if err != nil {
+		writeError(http.StatusBadRequest, err)
+		return
+	}
+	selector, err := labels.Parse(c.LabelSelector)
+	if err != nil {
+		writeError(http.StatusInternalServerError, err)
+		return
+	}
+	client := c.client.Resource(c.resource, dreq.namespace)
+	obj, err := client.Get(dreq.name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err) || (err == nil && !selector.Matches(labels.Set(obj.GetLabels()))):
+		writeError(http.StatusNotFound, fmt.Errorf("endpoints %s/%s not found", dreq.namespace, dreq.name))
+		return
+	case err != nil:
+		writeError(http.StatusInternalServerError, err)
+		return
+	}
+	drains, err := parseDrains(obj.GetAnnotations()[c.AnnotationDrain])
+	if err != nil {
+		writeError(http.StatusConflict, fmt.Errorf("drain annotation: %v", err))
+		return
+	}
+	for ip, d := range drains {
+		if !d.active(now) {
+			delete(drains, ip)
+		}
+	}
+	for _, ip := range dreq.ips {
+		if req.Method == http.MethodDelete {
+			delete(drains, ip)
+			continue
+		}
+		drains[ip] = dreq.drain
+	}
+	var annotation interface{}
+	if len(drains) > 0 {
+		annotation = formatDrains(drains)
+	}
+	// the resourceVersion fails the patch if the annotation changed since read
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": obj.GetResourceVersion(),
+			"annotations":     map[string]interface{}{c.AnnotationDrain: annotation},
+		},
+	})
+	if err == nil {
+		_, err = client.Patch(dreq.name, ptypes.MergePatchType, patch)
+	}
+	switch {
+	case errors.IsConflict(err):
+		writeError(http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(http.StatusInternalServerError, err)
+		return
+	}
+	c.logger.Printf("%s/%s: %s drain %s", dreq.namespace, dreq.name, strings.ToLower(req.Method), strings.Join(dreq.ips, ","))
+	records := map[string]drainStatusRecord{}
+	for ip, d := range drains {
+		records[ip] = d.record()
+	}
+	writeJSON(http.StatusOK, records)
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseDrains(t *testing.T) {
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	drains, err := parseDrains("10.0.0.5,10.0.0.6 10.0.0.7 remove=yes until=2030-01-02T03:04:05Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]drain{"10.0.0.5": {}, "10.0.0.6": {}, "10.0.0.7": {remove: true, until: until}}
+	if !reflect.DeepEqual(drains, want) {
+		t.Errorf("parseDrains() = %v, want %v", drains, want)
+	}
+	if formatted, err := parseDrains(formatDrains(drains)); err != nil || !reflect.DeepEqual(formatted, want) {
+		t.Errorf("parseDrains(formatDrains()) = %v, %v, want %v", formatted, err, want)
+	}
+	drains, err = parseDrains("10.0.0.5 until=tomorrow 10.0.0.x 10.0.0.6")
+	if err == nil || !reflect.DeepEqual(drains, map[string]drain{"10.0.0.6": {}}) {
+		t.Errorf("parseDrains() with illegal entries = %v, %v", drains, err)
+	}
+	if d := (drain{until: until}); !d.active(until.Add(-time.Second)) || d.active(until) || !(drain{}).active(until) {
+		t.Errorf("active() of %v", d)
+	}
+}
+
+func Test_parseDrainRequest(t *testing.T) {
+	now := time.Now()
+	dreq, err := parseDrainRequest(httptest.NewRequest("POST", "/drain?namespace=default&name=test&ip=10.0.0.5,10.0.0.6&ttl=10m&remove=yes", nil), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&drainRequest{"default", "test", []string{"10.0.0.5", "10.0.0.6"}, drain{remove: true, until: now.Add(10 * time.Minute)}}); !reflect.DeepEqual(dreq, want) {
+		t.Errorf("parseDrainRequest() = %v, want %v", dreq, want)
+	}
+	for _, invalid := range []string{
+		"/drain?name=test&ip=10.0.0.5",
+		"/drain?namespace=default&name=test&ip=x",
+		"/drain?namespace=default&name=test&ip=10.0.0.5&ttl=-1m",
+		"/drain?namespace=default&name=test&ip=10.0.0.5&until=tomorrow",
+	} {
+		if _, err := parseDrainRequest(httptest.NewRequest("POST", invalid, nil), now); err == nil {
+			t.Errorf("parseDrainRequest(%s) want error", invalid)
+		}
+	}
+}
+
+func Test_targetRecord_buildSubsets_drains(t *testing.T) {
+	h := testTarget(3, 1)
+	h.drains = map[string]drain{
+		"10.0.0.2": {},
+		"10.0.0.3": {remove: true},
+		"10.0.0.9": {remove: true, until: time.Now().Add(-time.Minute)},
+	}
+	subsets, update := h.buildSubsets()
+	if len(subsets[0].Addresses) != 0 || len(subsets[0].NotReadyAddresses) != 2 || !update {
+		t.Errorf("buildSubsets() = %v, %v", subsets, update)
+	}
+	h.updateSubsets(subsets).drains = nil
+	if subsets, update = h.buildSubsets(); len(subsets[0].Addresses) != 1 || len(subsets[0].NotReadyAddresses) != 1 || !update {
+		t.Errorf("buildSubsets() after undrain = %v, %v", subsets, update)
+	}
+}
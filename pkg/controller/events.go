@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	ptypes "k8s.io/apimachinery/pkg/types"
+	dynamic "k8s.io/client-go/deprecated-dynamic"
+)
+
+const (
+	// EventAddressBecameReady reason
+	EventAddressBecameReady = "AddressBecameReady"
+	// EventAddressBecameNotReady reason
+	EventAddressBecameNotReady = "AddressBecameNotReady"
+	// EventSourceLookupFailed reason
+	EventSourceLookupFailed = "SourceLookupFailed"
+	// EventInvalidProbeConfig reason
+	EventInvalidProbeConfig = "InvalidProbeConfig"
+	// EventPanicModeEntered reason
+	EventPanicModeEntered = "PanicModeEntered"
+	// EventPanicModeExited reason
+	EventPanicModeExited = "PanicModeExited"
+	// EventInvalidDrain reason
+	EventInvalidDrain = "InvalidDrain"
+	// EventServiceNotManaged reason
+	EventServiceNotManaged = "ServiceNotManaged"
+
+	eventComponent = "kube-service-importer"
+)
+
+type eventKey struct {
+	objectKey
+	eventType, reason, message string
+}
+
+type eventEntry struct {
+	name                 string
+	uid                  ptypes.UID
+	count                int32
+	first, last, written time.Time
+}
+
+type eventRecorder struct {
+	sync.Mutex
+	client        dynamic.Interface
+	resource      *metav1.APIResource
+	logger        *log.Logger
+	entries       map[eventKey]*eventEntry
+	queue         chan func()
+	dedupWindow   time.Duration
+	patchInterval time.Duration
+}
+
+func newEventRecorder(ctx context.Context, client dynamic.Interface, resource *metav1.APIResource, logger *log.Logger) *eventRecorder {
+	r := &eventRecorder{
+		client:        client,
+		resource:      resource,
+		logger:        logger,
+		entries:       map[eventKey]*eventEntry{},
+		queue:         make(chan func(), 1000),
+		dedupWindow:   10 * time.Minute,
+		patchInterval: time.Minute,
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case write := <-r.queue:
+				write()
+			}
+		}
+	}()
+	return r
+}
+
+// Event records an event against the Endpoints object, repeated events within dedupWindow
+// only increase the count of the first one, and are written at most once per patchInterval
+func (r *eventRecorder) Event(key objectKey, uid ptypes.UID, eventType, reason, message string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	now, ekey := time.Now(), eventKey{key, eventType, reason, message}
+	for k, entry := range r.entries {
+		if now.Sub(entry.last) > r.dedupWindow {
+			delete(r.entries, k)
+		}
+	}
+	entry, ok := r.entries[ekey]
+	if !ok {
+		entry = &eventEntry{name: fmt.Sprintf("%s.%x", key.name, now.UnixNano()), uid: uid, first: now}
+		r.entries[ekey] = entry
+	}
+	entry.count, entry.last = entry.count+1, now
+	if ok && now.Sub(entry.written) < r.patchInterval {
+		return
+	}
+	entry.written = now
+	event, created := r.buildEvent(ekey, entry), !ok
+	select {
+	case r.queue <- func() { r.write(event, created) }:
+	default:
+		r.logger.Printf("%s/%s: event dropped: %s %s", key.namespace, key.name, reason, message)
+	}
+}
+
+func (r *eventRecorder) buildEvent(key eventKey, entry *eventEntry) *corev1.Event {
+	return &corev1.Event{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Event"},
+		ObjectMeta: metav1.ObjectMeta{Name: entry.name, Namespace: key.namespace},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1", Kind: "Endpoints", Namespace: key.namespace, Name: key.name, UID: entry.uid,
+		},
+		Reason:         key.reason,
+		Message:        key.message,
+		Type:           key.eventType,
+		Count:          entry.count,
+		FirstTimestamp: metav1.Time{Time: entry.first},
+		LastTimestamp:  metav1.Time{Time: entry.last},
+		Source:         corev1.EventSource{Component: eventComponent},
+	}
+}
+
+func (r *eventRecorder) write(event *corev1.Event, created bool) {
+	client := r.client.Resource(r.resource, event.Namespace)
+	if !created {
+		patch, err := json.Marshal(map[string]interface{}{"count": event.Count, "lastTimestamp": event.LastTimestamp})
+		if err == nil {
+			if _, err = client.Patch(event.Name, ptypes.MergePatchType, patch); err == nil {
+				return
+			}
+		}
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(event)
+	if err == nil {
+		unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+		_, err = client.Create(&unstructured.Unstructured{Object: obj})
+	}
+	if err != nil {
+		r.logger.Printf("%s/%s: write event %s: %v", event.Namespace, event.InvolvedObject.Name, event.Reason, err)
+	}
+}
+
+func readyAddresses(subsets []corev1.EndpointSubset) map[string]bool {
+	ready := map[string]bool{}
+	for _, subset := range subsets {
+		for _, addr := range subset.NotReadyAddresses {
+			if _, ok := ready[addr.IP]; !ok {
+				ready[addr.IP] = false
+			}
+		}
+		for _, addr := range subset.Addresses {
+			ready[addr.IP] = true
+		}
+	}
+	return ready
+}
+
+// recordTransitions emits events for addresses present in both subsets whose readiness changed
+func (h *targetRecord) recordTransitions(oldSubsets, newSubsets []corev1.EndpointSubset) {
+	oldReady := readyAddresses(oldSubsets)
+	for ip, ready := range readyAddresses(newSubsets) {
+		switch wasReady, ok := oldReady[ip]; {
+		case !ok || wasReady == ready:
+		case ready:
+			h.c.events.Event(h.key, h.uid, corev1.EventTypeNormal, EventAddressBecameReady, fmt.Sprintf("address %s became ready", ip))
+		default:
+			h.c.events.Event(h.key, h.uid, corev1.EventTypeWarning, EventAddressBecameNotReady, fmt.Sprintf("address %s became not ready", ip))
+		}
+	}
+}
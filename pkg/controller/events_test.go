@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_eventRecorder_dedup(t *testing.T) {
+	r := &eventRecorder{
+		logger:        log.New(os.Stderr, "[test] ", log.Flags()),
+		entries:       map[eventKey]*eventEntry{},
+		queue:         make(chan func(), 10),
+		dedupWindow:   time.Minute,
+		patchInterval: time.Minute,
+	}
+	key := objectKey{"default", "test"}
+	for i := 0; i < 5; i++ {
+		r.Event(key, "", corev1.EventTypeWarning, EventAddressBecameNotReady, "address 1.1.1.1 became not ready")
+	}
+	r.Event(key, "", corev1.EventTypeNormal, EventAddressBecameReady, "address 1.1.1.1 became ready")
+	if got, want := len(r.queue), 2; got != want {
+		t.Errorf("queued writes = %v, want %v", got, want)
+	}
+	entry := r.entries[eventKey{key, corev1.EventTypeWarning, EventAddressBecameNotReady, "address 1.1.1.1 became not ready"}]
+	if entry == nil || entry.count != 5 {
+		t.Errorf("entry = %+v, want count 5", entry)
+	}
+
+	entry.written = entry.written.Add(-time.Minute)
+	r.Event(key, "", corev1.EventTypeWarning, EventAddressBecameNotReady, "address 1.1.1.1 became not ready")
+	if got, want := len(r.queue), 3; got != want {
+		t.Errorf("queued writes = %v, want %v", got, want)
+	}
+
+	var nilRecorder *eventRecorder
+	nilRecorder.Event(key, "", corev1.EventTypeNormal, EventAddressBecameReady, "noop")
+}
+
+func Test_readyAddresses(t *testing.T) {
+	subsets := []corev1.EndpointSubset{
+		{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}}, NotReadyAddresses: []corev1.EndpointAddress{{IP: "2.2.2.2"}}},
+		{NotReadyAddresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}}},
+	}
+	ready := readyAddresses(subsets)
+	if !ready["1.1.1.1"] || ready["2.2.2.2"] || len(ready) != 2 {
+		t.Errorf("readyAddresses() = %v", ready)
+	}
+}
@@ -0,0 +1,451 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	src "github.com/xiaopal/kube-service-importer/pkg/controller/source"
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+
+	"github.com/xiaopal/kube-informer/pkg/informer"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	ptypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// ImportAPIVersion apiVersion of ExternalServiceImport
+	ImportAPIVersion = "kube-service-importer.xiaopal.github.com/v1alpha1"
+	// ImportKind kind of ExternalServiceImport
+	ImportKind = "ExternalServiceImport"
+)
+
+type (
+	externalServiceImport struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata,omitempty"`
+		Spec              importSpec `json:"spec"`
+	}
+	importSpec struct {
+		Endpoints       string              `json:"endpoints,omitempty"`
+		HealthScope     string              `json:"healthScope,omitempty"`
+		Mode            string              `json:"mode,omitempty"`
+		MinReady        *intstr.IntOrString `json:"minReady,omitempty"`
+		MaxUnavailable  *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+		RemovalInterval string              `json:"removalInterval,omitempty"`
+		Service         bool                `json:"service,omitempty"`
+		Sources         []importSource      `json:"sources,omitempty"`
+		Probes          []importProbe       `json:"probes,omitempty"`
+	}
+	importSource struct {
+		Type        string            `json:"type"`
+		Name        string            `json:"name,omitempty"`
+		Interval    string            `json:"interval,omitempty"`
+		Timeout     string            `json:"timeout,omitempty"`
+		Port        int               `json:"port,omitempty"`
+		PortName    string            `json:"portName,omitempty"`
+		Protocol    string            `json:"protocol,omitempty"`
+		AppProtocol string            `json:"appProtocol,omitempty"`
+		Overwrite   *bool             `json:"overwrite,omitempty"`
+		Options     map[string]string `json:"options,omitempty"`
+	}
+	importProbe struct {
+		Type     string            `json:"type"`
+		Name     string            `json:"name,omitempty"`
+		Interval string            `json:"interval,omitempty"`
+		Timeout  string            `json:"timeout,omitempty"`
+		Port     int               `json:"port,omitempty"`
+		Rise     int               `json:"rise,omitempty"`
+		Fall     int               `json:"fall,omitempty"`
+		Headers  []string          `json:"headers,omitempty"`
+		Advisory bool              `json:"advisory,omitempty"`
+		Options  map[string]string `json:"options,omitempty"`
+	}
+	importAddressStatus struct {
+		IP     string  `json:"ip"`
+		Ports  []int32 `json:"ports,omitempty"`
+		Ready  bool    `json:"ready"`
+		Health string  `json:"health,omitempty"`
+	}
+	importSourceStatus struct {
+		Name          string       `json:"name"`
+		Addresses     int          `json:"addresses"`
+		LastRefresh   *metav1.Time `json:"lastRefresh,omitempty"`
+		Error         string       `json:"error,omitempty"`
+		LastErrorTime *metav1.Time `json:"lastErrorTime,omitempty"`
+	}
+)
+
+func (imp *externalServiceImport) endpointsName() string {
+	if imp.Spec.Endpoints != "" {
+		return imp.Spec.Endpoints
+	}
+	return imp.Name
+}
+
+func configWith(conf fluconf.Config, options map[string]string, vals map[string]string) fluconf.Config {
+	for key, val := range options {
+		conf[key] = val
+	}
+	for key, val := range vals {
+		if val != "" {
+			conf[key] = val
+		}
+	}
+	return conf
+}
+
+func intString(val int) string {
+	if val == 0 {
+		return ""
+	}
+	return strconv.Itoa(val)
+}
+
+func (s importSource) config() fluconf.Config {
+	conf := configWith(fluconf.Config{}, s.Options, map[string]string{
+		"name":         s.Name,
+		"interval":     s.Interval,
+		"timeout":      s.Timeout,
+		"port":         intString(s.Port),
+		"protocol":     s.Protocol,
+		"app-protocol": s.AppProtocol,
+	})
+	// a named port is name:port, or port-name= for ports of SRV records
+	switch {
+	case s.PortName != "" && s.Port > 0:
+		conf["port"] = s.PortName + ":" + intString(s.Port)
+	case s.PortName != "":
+		conf["port-name"] = s.PortName
+	}
+	if s.Overwrite != nil {
+		conf["overwrite"] = strconv.FormatBool(*s.Overwrite)
+	}
+	conf["source"] = s.Type
+	return conf
+}
+
+func (p importProbe) config() fluconf.Config {
+	conf := configWith(fluconf.Config{}, p.Options, map[string]string{
+		"name":     p.Name,
+		"interval": p.Interval,
+		"timeout":  p.Timeout,
+		"port":     intString(p.Port),
+		"rise":     intString(p.Rise),
+		"fall":     intString(p.Fall),
+		"header":   strings.Join(p.Headers, "\n"),
+	})
+	if p.Advisory {
+		conf["advisory"] = "true"
+	}
+	conf["probe"] = p.Type
+	return conf
+}
+
+// configs validates the spec and converts it to annotation configs
+func (spec importSpec) configs() (sourceConfs []fluconf.Config, probeConfs []fluconf.Config, err error) {
+	for i, source := range spec.Sources {
+		conf := source.config()
+		factory, ok := src.SourceFuncFactories[source.Type]
+		if !ok {
+			return nil, nil, fmt.Errorf("sources[%d]: illegal source type %q", i, source.Type)
+		}
+		if _, _, err := factory(conf); err != nil {
+			return nil, nil, fmt.Errorf("sources[%d]: %v", i, err)
+		}
+		sourceConfs = append(sourceConfs, conf)
+	}
+	switch spec.HealthScope {
+	case "", HealthScopePort, HealthScopeHost:
+	default:
+		return nil, nil, fmt.Errorf("illegal healthScope %q", spec.HealthScope)
+	}
+	if spec.Mode != "" {
+		if _, err := parseProbeMode(spec.Mode); err != nil {
+			return nil, nil, err
+		}
+	}
+	if spec.MinReady != nil {
+		if _, err := parseThreshold("minReady", spec.MinReady.String()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if spec.MaxUnavailable != nil {
+		if _, err := parseThreshold("maxUnavailable", spec.MaxUnavailable.String()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if spec.RemovalInterval != "" {
+		if _, err := time.ParseDuration(spec.RemovalInterval); err != nil {
+			return nil, nil, fmt.Errorf("illegal removalInterval %q", spec.RemovalInterval)
+		}
+	}
+	for i, probe := range spec.Probes {
+		conf := probe.config()
+		if err := validateProbeConf(conf); err != nil {
+			return nil, nil, fmt.Errorf("probes[%d]: %v", i, err)
+		}
+		probeConfs = append(probeConfs, conf)
+	}
+	return sourceConfs, probeConfs, nil
+}
+
+// probeOptions returns the options shared by all probes
+func (spec importSpec) probeOptions() fluconf.Config {
+	conf := configWith(fluconf.Config{}, nil, map[string]string{
+		"health-scope":     spec.HealthScope,
+		"mode":             spec.Mode,
+		"removal-interval": spec.RemovalInterval,
+	})
+	if spec.MinReady != nil {
+		conf["min-ready"] = spec.MinReady.String()
+	}
+	if spec.MaxUnavailable != nil {
+		conf["max-unavailable"] = spec.MaxUnavailable.String()
+	}
+	return conf
+}
+
+func (spec importSpec) serviceValue() interface{} {
+	if !spec.Service {
+		return nil
+	}
+	return "true"
+}
+
+func importOwner(refs []metav1.OwnerReference) string {
+	for _, ref := range refs {
+		if ref.APIVersion == ImportAPIVersion && ref.Kind == ImportKind {
+			return ref.Name
+		}
+	}
+	return ""
+}
+
+func annotationValue(shared fluconf.Config, confs []fluconf.Config, entryKey string) interface{} {
+	if len(confs) == 0 {
+		return nil
+	}
+	return fluconf.FormatShared(shared, confs, entryKey)
+}
+
+func (c *endpointsImporter) handleImportEvent(event informer.EventType, obj *unstructured.Unstructured) error {
+	if event == informer.EventDelete {
+		// owned endpoints are garbage collected
+		return nil
+	}
+	imp := &externalServiceImport{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), imp); err != nil {
+		return err
+	}
+	status := map[string]interface{}{
+		"observedGeneration": imp.Generation,
+		"endpoints":          imp.endpointsName(),
+		"error":              nil,
+	}
+	sourceConfs, probeConfs, err := imp.Spec.configs()
+	if err == nil {
+		err = c.applyImportEndpoints(imp, map[string]interface{}{
+			c.AnnotationSources: annotationValue(nil, sourceConfs, "source"),
+			c.AnnotationProbes:  annotationValue(imp.Spec.probeOptions(), probeConfs, "probe"),
+			c.AnnotationService: imp.Spec.serviceValue(),
+		})
+	}
+	if err != nil {
+		c.logger.Printf("%s/%s: import: %v", imp.Namespace, imp.Name, err)
+		status["error"] = err.Error()
+	}
+	return c.patchImportStatus(imp.Namespace, imp.Name, status)
+}
+
+func (c *endpointsImporter) applyImportEndpoints(imp *externalServiceImport, annotations map[string]interface{}) error {
+	selectorLabels, err := labels.ConvertSelectorToLabelsMap(c.LabelSelector)
+	if err != nil {
+		return err
+	}
+	name, client := imp.endpointsName(), c.client.Resource(c.resource, imp.Namespace)
+	existing, err := client.Get(name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		endpoints := &corev1.Endpoints{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Endpoints"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   imp.Namespace,
+				Labels:      map[string]string(selectorLabels),
+				Annotations: map[string]string{},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: ImportAPIVersion, Kind: ImportKind, Name: imp.Name, UID: imp.UID,
+					Controller: boolPtr(true), BlockOwnerDeletion: boolPtr(true),
+				}},
+			},
+		}
+		for key, val := range annotations {
+			if val != nil {
+				endpoints.Annotations[key] = val.(string)
+			}
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(endpoints)
+		if err != nil {
+			return err
+		}
+		unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+		_, err = client.Create(&unstructured.Unstructured{Object: obj})
+		return err
+	case err != nil:
+		return err
+	case importOwner(existing.GetOwnerReferences()) != imp.Name:
+		return fmt.Errorf("endpoints %s exists and is not owned by %s", name, imp.Name)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": selectorLabels, "annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Patch(name, ptypes.MergePatchType, patch)
+	return err
+}
+
+func (c *endpointsImporter) patchImportStatus(namespace, name string, status map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	statusResource := *c.importResource
+	statusResource.Name += "/status"
+	_, err = c.importClient.Resource(&statusResource, namespace).Patch(name, ptypes.MergePatchType, patch)
+	return err
+}
+
+// importStatus is the status of the published subsets, with health of their probes, sources and drains
+func (h *targetRecord) importStatus(subsets []corev1.EndpointSubset) map[string]interface{} {
+	addresses := []importAddressStatus{}
+	appendAddresses := func(subset corev1.EndpointSubset, addrs []corev1.EndpointAddress, ready bool) {
+		ports := make([]int32, len(subset.Ports))
+		for i, port := range subset.Ports {
+			ports[i] = port.Port
+		}
+		for _, addr := range addrs {
+			addrStatus := importAddressStatus{IP: addr.IP, Ports: ports, Ready: ready}
+			switch status, statusOK := h.hostStatus(addr.IP, subset.Ports); {
+			case statusOK && status:
+				addrStatus.Health = "Healthy"
+			case statusOK:
+				addrStatus.Health = "Unhealthy"
+			case len(h.probeConfs) > 0:
+				addrStatus.Health = "Unknown"
+			}
+			addresses = append(addresses, addrStatus)
+		}
+	}
+	for _, subset := range subsets {
+		appendAddresses(subset, subset.Addresses, true)
+		appendAddresses(subset, subset.NotReadyAddresses, false)
+	}
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].IP < addresses[j].IP
+	})
+	sources := []importSourceStatus{}
+	for key := range h.sources {
+		sourceStatus, state := importSourceStatus{Name: key.source}, h.sourceState(key)
+		if results, ok := h.c.statusUpdater.Status(key); ok {
+			ips := map[string]bool{}
+			for _, result := range *results.(*[]src.LoadResult) {
+				for _, ip := range result.IPs {
+					ips[ip] = true
+				}
+			}
+			sourceStatus.Addresses = len(ips)
+		}
+		if !state.lastRefresh.IsZero() {
+			sourceStatus.LastRefresh = &metav1.Time{Time: state.lastRefresh}
+		}
+		if state.lastError != nil {
+			sourceStatus.Error, sourceStatus.LastErrorTime = state.lastError.Error(), &metav1.Time{Time: state.lastErrorTime}
+		}
+		sources = append(sources, sourceStatus)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+	drains := map[string]drainStatusRecord{}
+	for ip, d := range h.activeDrains(time.Now()) {
+		drains[ip] = d.record()
+	}
+	return map[string]interface{}{"addresses": addresses, "sources": sources, "panic": h.panicMode, "drains": drains}
+}
+
+// importStatusSignature is the status without refresh and error times of sources, as they change on every refresh
+// and are rate limited, see importStatusToPatch
+func importStatusSignature(status map[string]interface{}) (string, error) {
+	signature, sources := map[string]interface{}{}, []importSourceStatus{}
+	for key, val := range status {
+		signature[key] = val
+	}
+	for _, source := range status["sources"].([]importSourceStatus) {
+		source.LastRefresh, source.LastErrorTime = nil, nil
+		sources = append(sources, source)
+	}
+	signature["sources"] = sources
+	data, err := json.Marshal(signature)
+	return string(data), err
+}
+
+// importStatusToPatch is the status data to patch, and its signature: changes other than refresh and error times of
+// sources are patched at once, and refreshes at most once per StatusInterval, with wait until the next refresh
+func (h *targetRecord) importStatusToPatch(status map[string]interface{}, now time.Time) (data string, signature string, wait time.Duration, err error) {
+	if signature, err = importStatusSignature(status); err != nil {
+		return "", "", 0, err
+	}
+	raw, err := json.Marshal(status)
+	if err != nil || string(raw) == h.publishedStatusData {
+		return "", "", 0, err
+	}
+	if signature == h.publishedStatus {
+		if h.c.StatusInterval <= 0 {
+			return "", "", 0, nil
+		}
+		if wait = h.importStatusPatched.Add(h.c.StatusInterval).Sub(now); wait > 0 {
+			return "", "", wait, nil
+		}
+	}
+	return string(raw), signature, h.c.StatusInterval, nil
+}
+
+// importStatusWrite patches the status of the ExternalServiceImport of the target with the subsets if changed, wait is
+// the time until refreshes of sources are to be published
+func (h *targetRecord) importStatusWrite(subsets []corev1.EndpointSubset, now time.Time) (targetWrite, time.Duration, error) {
+	if h.importName == "" || h.c.importClient == nil {
+		return targetWrite{}, 0, nil
+	}
+	status := h.importStatus(subsets)
+	data, signature, wait, err := h.importStatusToPatch(status, now)
+	if err != nil || data == "" {
+		return targetWrite{}, wait, err
+	}
+	c, namespace, name := h.c, h.key.namespace, h.importName
+	return targetWrite{
+		write: func() error {
+			if err := c.patchImportStatus(namespace, name, status); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			return nil
+		},
+		done: func(err error) error {
+			if err == nil {
+				h.publishedStatus, h.publishedStatusData, h.importStatusPatched = signature, data, now
+			}
+			return nil
+		},
+	}, wait, nil
+}
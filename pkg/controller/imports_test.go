@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_importSpec_configs(t *testing.T) {
+	overwrite := true
+	spec := importSpec{
+		Sources: []importSource{
+			{Type: "static", Port: 80, Overwrite: &overwrite, Options: map[string]string{"ip": "1.1.1.1,2.2.2.2"}},
+			{Type: "static", Port: 443, PortName: "https", AppProtocol: "https", Options: map[string]string{"ip": "3.3.3.3"}},
+		},
+		Probes: []importProbe{
+			{Type: "http", Rise: 2, Headers: []string{"X-A: 1", "X-B: 2"}, Options: map[string]string{"uri": "/health check"}},
+		},
+	}
+	sourceConfs, probeConfs, err := spec.configs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []fluconf.Config{{"source": "static", "ip": "1.1.1.1,2.2.2.2", "port": "80", "overwrite": "true"},
+		{"source": "static", "ip": "3.3.3.3", "port": "https:443", "app-protocol": "https"},
+	}; !reflect.DeepEqual(sourceConfs, want) {
+		t.Errorf("sources = %v, want %v", sourceConfs, want)
+	}
+	if got := fluconf.Parse(fluconf.Format(probeConfs, "probe"), "probe", nil); !reflect.DeepEqual(got, probeConfs) {
+		t.Errorf("probes = %v, want %v", got, probeConfs)
+	}
+	if got, want := probeConfs[0].GetStrings("header"), []string{"X-A: 1", "X-B: 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("headers = %v, want %v", got, want)
+	}
+
+	for _, invalid := range []importSpec{
+		{Sources: []importSource{{Type: "unknown"}}},
+		{Sources: []importSource{{Type: "static"}}},
+		{Probes: []importProbe{{Type: "unknown"}}},
+		{Probes: []importProbe{{Type: "http", Headers: []string{"invalid"}}}},
+		{HealthScope: "unknown", Probes: []importProbe{{Type: "tcp"}}},
+		{Mode: "quorum:0", Probes: []importProbe{{Type: "tcp"}}},
+	} {
+		if _, _, err := invalid.configs(); err == nil {
+			t.Errorf("configs(%v) want error", invalid)
+		}
+	}
+}
+
+func Test_importStatusSignature(t *testing.T) {
+	status := func(refresh time.Time, addresses int) map[string]interface{} {
+		sources := []importSourceStatus{{Name: "static", Addresses: addresses, LastRefresh: &metav1.Time{Time: refresh}}}
+		return map[string]interface{}{"addresses": []importAddressStatus{}, "sources": sources, "panic": false}
+	}
+	now := time.Now()
+	published := status(now, 1)
+	signature, err := importStatusSignature(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published["sources"].([]importSourceStatus)[0].LastRefresh == nil {
+		t.Errorf("importStatusSignature() modified the status")
+	}
+	if refreshed, _ := importStatusSignature(status(now.Add(time.Minute), 1)); refreshed != signature {
+		t.Errorf("importStatusSignature() of a refresh = %s, want %s", refreshed, signature)
+	}
+	if changed, _ := importStatusSignature(status(now, 2)); changed == signature {
+		t.Errorf("importStatusSignature() of changed addresses = %s", changed)
+	}
+}
+
+func Test_targetRecord_importStatusToPatch(t *testing.T) {
+	status := func(refresh time.Time, addresses int) map[string]interface{} {
+		sources := []importSourceStatus{{Name: "static", Addresses: addresses, LastRefresh: &metav1.Time{Time: refresh}}}
+		return map[string]interface{}{"addresses": []importAddressStatus{}, "sources": sources, "panic": false}
+	}
+	h := &targetRecord{c: &endpointsImporter{ImporterOpts: ImporterOpts{StatusInterval: time.Minute}}}
+	now := time.Now().Truncate(time.Second)
+	data, signature, wait, err := h.importStatusToPatch(status(now, 1), now)
+	if err != nil || data == "" || wait != time.Minute {
+		t.Fatalf("importStatusToPatch() of a new status = %q, %v, %v", data, wait, err)
+	}
+	h.publishedStatus, h.publishedStatusData, h.importStatusPatched = signature, data, now
+	if data, _, wait, _ := h.importStatusToPatch(status(now, 1), now); data != "" || wait != 0 {
+		t.Errorf("importStatusToPatch() of the published status = %q, %v", data, wait)
+	}
+	if data, _, wait, _ := h.importStatusToPatch(status(now.Add(10*time.Second), 1), now.Add(10*time.Second)); data != "" || wait != 50*time.Second {
+		t.Errorf("importStatusToPatch() of an early refresh = %q, %v, want wait 50s", data, wait)
+	}
+	if data, _, _, _ := h.importStatusToPatch(status(now.Add(time.Minute), 1), now.Add(time.Minute)); data == "" {
+		t.Errorf("importStatusToPatch() of a refresh after StatusInterval was not patched")
+	}
+	if data, _, _, _ := h.importStatusToPatch(status(now.Add(10*time.Second), 2), now.Add(10*time.Second)); data == "" {
+		t.Errorf("importStatusToPatch() of changed addresses was not patched at once")
+	}
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+)
+
+type importerMetrics struct {
+	registry       *prometheus.Registry
+	probeDuration  *prometheus.HistogramVec
+	probeResults   *prometheus.CounterVec
+	sourceDuration *prometheus.HistogramVec
+	sourceErrors   *prometheus.CounterVec
+	retries        prometheus.Counter
+	patches        *prometheus.CounterVec
+}
+
+var probeResults = []string{"success", "failure", "unknown", "error"}
+
+// gaugeFunc collects gauges with labels from the importer state on every scrape
+type gaugeFunc struct {
+	desc    *prometheus.Desc
+	collect func(emit func(float64, ...string))
+}
+
+func newGaugeFunc(name, help string, labelNames []string, collect func(emit func(float64, ...string))) *gaugeFunc {
+	return &gaugeFunc{desc: prometheus.NewDesc(name, help, labelNames, nil), collect: collect}
+}
+
+// Describe implements prometheus.Collector
+func (g *gaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector
+func (g *gaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	g.collect(func(val float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, val, labelValues...)
+	})
+}
+
+func newImporterMetrics(c *endpointsImporter) *importerMetrics {
+	m := &importerMetrics{
+		registry: prometheus.NewRegistry(),
+		probeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "kube_service_importer_probe_duration_seconds",
+			Help: "Probe latency in seconds."}, []string{"namespace", "name", "host", "probe"}),
+		probeResults: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "kube_service_importer_probe_results_total",
+			Help: "Probe results by result (success, failure, unknown, error)."}, []string{"namespace", "name", "host", "probe", "result"}),
+		sourceDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "kube_service_importer_source_refresh_duration_seconds",
+			Help: "Source refresh duration in seconds."}, []string{"namespace", "name", "source"}),
+		sourceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "kube_service_importer_source_errors_total",
+			Help: "Source refresh errors."}, []string{"namespace", "name", "source"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{Name: "kube_service_importer_workqueue_retries_total",
+			Help: "Updates requeued after an error."}),
+		patches: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "kube_service_importer_patches_total",
+			Help: "Writes of imported addresses by resource and result (success, failure)."}, []string{"namespace", "name", "resource", "result"}),
+	}
+	m.registry.MustRegister(m.probeDuration, m.probeResults, m.sourceDuration, m.sourceErrors, m.retries, m.patches)
+	m.registry.MustRegister(newGaugeFunc("kube_service_importer_address_ready",
+		"Whether an imported address is ready (1) or not ready (0).", []string{"namespace", "name", "ip"},
+		func(emit func(float64, ...string)) {
+			c.Lock()
+			defer c.Unlock()
+			for key, target := range c.targets {
+				for ip, ready := range readyAddresses(target.lastSubsets()) {
+					val := 0.0
+					if ready {
+						val = 1
+					}
+					emit(val, key.namespace, key.name, ip)
+				}
+			}
+		}))
+	m.registry.MustRegister(newGaugeFunc("kube_service_importer_panic_mode",
+		"Whether unhealthy addresses are kept ready (1) as fewer than min-ready addresses would be ready.", []string{"namespace", "name"},
+		func(emit func(float64, ...string)) {
+			c.Lock()
+			defer c.Unlock()
+			for key, target := range c.targets {
+				if target.minReady == nil {
+					continue
+				}
+				val := 0.0
+				if target.panicMode {
+					val = 1
+				}
+				emit(val, key.namespace, key.name)
+			}
+		}))
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "kube_service_importer_workqueue_depth",
+		Help: "Pending updates in the workqueue."},
+		func() float64 {
+			return float64(c.updateQueue.Len())
+		}))
+	c.statusUpdater.SetObserver(m.observe)
+	return m
+}
+
+// handler serves the metrics in the Prometheus exposition formats
+func (m *importerMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *importerMetrics) observe(key interface{}, status interface{}, err error, duration time.Duration) {
+	switch k := key.(type) {
+	case probeKey:
+		m.probeDuration.WithLabelValues(k.namespace, k.name, k.hostKey.String(), k.probe).Observe(duration.Seconds())
+		m.probeResults.WithLabelValues(k.namespace, k.name, k.hostKey.String(), k.probe, strings.ToLower(probeResult(status, err))).Inc()
+	case sourceKey:
+		m.sourceDuration.WithLabelValues(k.namespace, k.name, k.source).Observe(duration.Seconds())
+		if err != nil && err != prober.ErrorStatusUnknown {
+			m.sourceErrors.WithLabelValues(k.namespace, k.name, k.source).Inc()
+		}
+	}
+}
+
+func (m *importerMetrics) forgetProbe(key probeKey) {
+	m.probeDuration.DeleteLabelValues(key.namespace, key.name, key.hostKey.String(), key.probe)
+	for _, result := range probeResults {
+		m.probeResults.DeleteLabelValues(key.namespace, key.name, key.hostKey.String(), key.probe, result)
+	}
+}
+
+func (m *importerMetrics) forgetSource(key sourceKey) {
+	m.sourceDuration.DeleteLabelValues(key.namespace, key.name, key.source)
+	m.sourceErrors.DeleteLabelValues(key.namespace, key.name, key.source)
+}
+
+func (m *importerMetrics) patched(key objectKey, resource string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.patches.WithLabelValues(key.namespace, key.name, resource, result).Inc()
+}
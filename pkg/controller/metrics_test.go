@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_importerMetrics_forgetProbe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &endpointsImporter{statusUpdater: prober.NewStatusUpdater(ctx, log.New(ioutil.Discard, "", 0)), updateQueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())}
+	m, key := newImporterMetrics(c), objectKey{"default", "test"}
+	first, second := probeKey{key, hostKey{"10.0.0.1", 80, "TCP"}, "tcp"}, probeKey{key, hostKey{"10.0.0.2", 80, "TCP"}, "tcp"}
+	m.observe(first, true, nil, time.Millisecond)
+	m.observe(second, true, nil, time.Millisecond)
+	m.forgetProbe(first)
+	res := httptest.NewRecorder()
+	m.handler().ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]bool{}
+	for _, metric := range families["kube_service_importer_probe_results_total"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "host" {
+				hosts[label.GetValue()] = true
+			}
+		}
+	}
+	if want := map[string]bool{"10.0.0.2:80": true}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("probe result hosts after forgetProbe(%v) = %v, want %v", first, hosts, want)
+	}
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// probeSecretRefs maps secret reference options of probes to the secret keys and inline options they load
+var probeSecretRefs = map[string]map[string]string{
+	"ca-secret":   {"ca.crt": "ca-data"},
+	"cert-secret": {"tls.crt": "cert-data", "tls.key": "key-data"},
+}
+
+// probeSecretExpiry drops cached secrets no longer referenced by probes
+const probeSecretExpiry = 10 * time.Minute
+
+type (
+	// probeSecretCache shares secrets between probes of all hosts, reloaded once older than the probe interval
+	probeSecretCache struct {
+		sync.Mutex
+		secrets map[objectKey]probeSecret
+	}
+	probeSecret struct {
+		data   map[string][]byte
+		err    error
+		loaded time.Time
+	}
+)
+
+func (c *endpointsImporter) secretData(namespace, name string) (map[string][]byte, error) {
+	obj, err := c.secretClient.Resource(c.secretResource, namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	encoded, _, err := unstructured.NestedStringMap(obj.UnstructuredContent(), "data")
+	if err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{}
+	for key, val := range encoded {
+		if data[key], err = base64.StdEncoding.DecodeString(val); err != nil {
+			return nil, fmt.Errorf("secret %s: key %s: %v", name, key, err)
+		}
+	}
+	return data, nil
+}
+
+// cachedSecretData is the secret loaded at most maxAge ago; secrets are loaded without the lock of the importer
+func (c *endpointsImporter) cachedSecretData(namespace, name string, maxAge time.Duration) (map[string][]byte, error) {
+	cache, key, now := &c.probeSecrets, objectKey{namespace, name}, time.Now()
+	cache.Lock()
+	defer cache.Unlock()
+	if secret, ok := cache.secrets[key]; ok && now.Sub(secret.loaded) < maxAge {
+		return secret.data, secret.err
+	}
+	if cache.secrets == nil {
+		cache.secrets = map[objectKey]probeSecret{}
+	}
+	for key, secret := range cache.secrets {
+		if now.Sub(secret.loaded) > probeSecretExpiry {
+			delete(cache.secrets, key)
+		}
+	}
+	data, err := c.secretData(namespace, name)
+	cache.secrets[key] = probeSecret{data: data, err: err, loaded: now}
+	return data, err
+}
+
+// resolveProbeSecrets loads secrets referenced by probe options (in the namespace of the Endpoints) as inline options
+func (c *endpointsImporter) resolveProbeSecrets(namespace string, conf fluconf.Config) (fluconf.Config, error) {
+	resolved := conf
+	for ref, keys := range probeSecretRefs {
+		name, ok := conf[ref]
+		if !ok {
+			continue
+		}
+		if c.secretClient == nil {
+			return nil, fmt.Errorf("%s: secrets not available", ref)
+		}
+		data, err := c.cachedSecretData(namespace, name, conf.GetDuration("interval", 5*time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ref, err)
+		}
+		resolved = resolved.Copy()
+		for key, option := range keys {
+			val, ok := data[key]
+			if !ok {
+				return nil, fmt.Errorf("%s: secret %s has no key %s", ref, name, key)
+			}
+			resolved[option] = string(val)
+		}
+	}
+	return resolved, nil
+}
+
+// loadProbe loads the prober of conf; secrets referenced by conf are resolved by every probe, so that rotated
+// secrets are picked up and probes of secrets that can not be loaded fail with the error rather than being dropped
+func (h *targetRecord) loadProbe(conf fluconf.Config, updater prober.SimpleStatusUpdateFunc) prober.StatusProber {
+	refs := false
+	for ref := range probeSecretRefs {
+		_, ok := conf[ref]
+		refs = refs || ok
+	}
+	if !refs {
+		return prober.LoadSimpleStatusProber(conf, updater)
+	}
+	c, key, uid := h.c, h.key, h.uid
+	return prober.LoadResolvedStatusProber(conf, func(conf fluconf.Config) (fluconf.Config, error) {
+		resolved, err := c.resolveProbeSecrets(key.namespace, conf)
+		if err != nil {
+			c.events.Event(key, uid, corev1.EventTypeWarning, EventInvalidProbeConfig, fmt.Sprintf("probe %s: %v", conf["probe"], err))
+		}
+		return resolved, err
+	}, updater)
+}
@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/xiaopal/kube-informer/pkg/informer"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	ptypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func servicePortName(port corev1.EndpointPort) string {
+	return fmt.Sprintf("%s-%d", strings.ToLower(string(port.Protocol)), port.Port)
+}
+
+// nameServicePorts names unnamed ports if the subsets have more than one port, as ports of multi-port Services
+// must be named and Endpoints ports are matched to them by name
+func nameServicePorts(subsets []corev1.EndpointSubset) bool {
+	ports, named := map[string]bool{}, false
+	for _, subset := range subsets {
+		for _, port := range subset.Ports {
+			ports[servicePortName(port)] = true
+		}
+	}
+	if len(ports) <= 1 {
+		return false
+	}
+	for i := range subsets {
+		subsetPorts := append([]corev1.EndpointPort{}, subsets[i].Ports...)
+		for j := range subsetPorts {
+			if subsetPorts[j].Name == "" {
+				subsetPorts[j].Name, named = servicePortName(subsetPorts[j]), true
+			}
+		}
+		subsets[i].Ports = subsetPorts
+	}
+	return named
+}
+
+// servicePorts are the distinct ports of the subsets
+func servicePorts(subsets []corev1.EndpointSubset) []corev1.ServicePort {
+	ports, seen := []corev1.ServicePort{}, map[corev1.EndpointPort]bool{}
+	for _, subset := range subsets {
+		for _, port := range subset.Ports {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, corev1.ServicePort{Name: port.Name, Protocol: port.Protocol, Port: port.Port, TargetPort: intstr.FromInt(int(port.Port))})
+			}
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return ports[i].Port < ports[j].Port
+		}
+		return ports[i].Protocol < ports[j].Protocol
+	})
+	return ports
+}
+
+func withOwner(refs []metav1.OwnerReference, owner metav1.OwnerReference) ([]metav1.OwnerReference, bool) {
+	for _, ref := range refs {
+		if ref.UID == owner.UID {
+			return refs, false
+		}
+	}
+	return append(append([]metav1.OwnerReference{}, refs...), owner), true
+}
+
+func (c *endpointsImporter) createService(key objectKey, owner *metav1.OwnerReference, ports []corev1.ServicePort, appProtocols map[string]string) (*unstructured.Unstructured, error) {
+	selectorLabels, err := labels.ConvertSelectorToLabelsMap(c.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	service := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            key.name,
+			Namespace:       key.namespace,
+			Labels:          map[string]string(selectorLabels),
+			OwnerReferences: []metav1.OwnerReference{*owner},
+		},
+		Spec: corev1.ServiceSpec{Ports: ports},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(service)
+	if err != nil {
+		return nil, err
+	}
+	unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(obj, "status")
+	spec := obj["spec"].(map[string]interface{})
+	if spec["ports"], err = withAppProtocols(spec["ports"], appProtocols); err != nil {
+		return nil, err
+	}
+	return c.serviceClient.Resource(c.serviceResource, key.namespace).Create(&unstructured.Unstructured{Object: obj})
+}
+
+// cachedService is the informer copy of the Service of key, nil if there is no Service matching the label selector
+func (c *endpointsImporter) cachedService(key objectKey) (*unstructured.Unstructured, error) {
+	indexer, ok := c.informer.GetIndexer(c.serviceWatch)
+	if !ok {
+		return nil, fmt.Errorf("services are not watched")
+	}
+	obj, exists, err := indexer.GetByKey(key.namespace + "/" + key.name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return obj.(*unstructured.Unstructured), nil
+}
+
+// jsonValue is val as decoded JSON, eg. to compare typed values with unstructured ones
+func jsonValue(val interface{}) (interface{}, error) {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	var ret interface{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// serviceWrite syncs the Service of the subsets if enabled
+func (h *targetRecord) serviceWrite(subsets []corev1.EndpointSubset) (targetWrite, error) {
+	ports, owner, appProtocols := servicePorts(subsets), h.owner(), h.appProtocols()
+	if !h.service || owner == nil || len(ports) == 0 {
+		return targetWrite{}, nil
+	}
+	live, err := h.c.cachedService(h.key)
+	if err != nil {
+		return targetWrite{}, err
+	}
+	key, uid := h.key, h.uid
+	return targetWrite{write: func() error {
+		return h.c.syncService(key, uid, owner, ports, appProtocols, live)
+	}}, nil
+}
+
+// syncService creates or updates the selector-less Service of the Endpoints with ports of the subsets, compared with
+// live, the informer copy of the Service. Only Services matching the label selector are managed: created Services are
+// labelled and owned by the Endpoints, and other Services of the same name are reported as not managed
+func (c *endpointsImporter) syncService(key objectKey, uid ptypes.UID, owner *metav1.OwnerReference, ports []corev1.ServicePort, appProtocols map[string]string, live *unstructured.Unstructured) error {
+	var err error
+	if live == nil {
+		_, err = c.createService(key, owner, ports, appProtocols)
+		if errors.IsAlreadyExists(err) {
+			return c.serviceExists(key, uid)
+		}
+	} else {
+		existing := &corev1.Service{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(live.UnstructuredContent(), existing); err != nil {
+			return err
+		}
+		if len(existing.Spec.Selector) > 0 {
+			c.events.Event(key, uid, corev1.EventTypeWarning, EventServiceNotManaged, fmt.Sprintf("service %s has a selector", key.name))
+			return nil
+		}
+		for i := range ports {
+			for _, port := range existing.Spec.Ports {
+				if port.Port == ports[i].Port && port.Protocol == ports[i].Protocol {
+					ports[i].NodePort = port.NodePort
+				}
+			}
+		}
+		refs, added := withOwner(existing.OwnerReferences, *owner)
+		portsValue, err := withAppProtocols(ports, appProtocols)
+		if err != nil {
+			return err
+		}
+		desired, err := jsonValue(portsValue)
+		if err != nil {
+			return err
+		}
+		livePorts, _, _ := unstructured.NestedFieldNoCopy(live.Object, "spec", "ports")
+		current, err := jsonValue(livePorts)
+		if err != nil {
+			return err
+		}
+		if !added && reflect.DeepEqual(desired, current) {
+			return nil
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"ownerReferences": refs},
+			"spec":     map[string]interface{}{"ports": portsValue},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = c.serviceClient.Resource(c.serviceResource, key.namespace).Patch(key.name, ptypes.MergePatchType, patch)
+	}
+	c.metrics.patched(key, "service", err)
+	if err != nil {
+		return fmt.Errorf("sync service: %v", err)
+	}
+	c.logger.Printf("%s/%s: service updated", key.namespace, key.name)
+	return nil
+}
+
+// serviceExists handles a Service that exists but is not in the informer cache: either it does not match the label
+// selector, or it was created recently and the watch lags behind, in which case its event notifies the update again
+func (c *endpointsImporter) serviceExists(key objectKey, uid ptypes.UID) error {
+	selector, err := labels.Parse(c.LabelSelector)
+	if err != nil {
+		return err
+	}
+	obj, err := c.serviceClient.Resource(c.serviceResource, key.namespace).Get(key.name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		return fmt.Errorf("sync service: service %s was deleted", key.name)
+	case err != nil:
+		return fmt.Errorf("sync service: %v", err)
+	case !selector.Matches(labels.Set(obj.GetLabels())):
+		c.events.Event(key, uid, corev1.EventTypeWarning, EventServiceNotManaged, fmt.Sprintf("service %s does not match %s", key.name, c.LabelSelector))
+	}
+	return nil
+}
+
+// handleServiceEvent notifies the update of the Endpoints of a managed Service, so that edited Services are repaired.
+// As the Endpoints own their Service, deleting a Service owned by them deletes the Endpoints too, so that deleting
+// either cleans up the other; Endpoints of an ExternalServiceImport belong to the import, and the Service is recreated
+func (c *endpointsImporter) handleServiceEvent(event informer.EventType, obj *unstructured.Unstructured) error {
+	key := objectKey{obj.GetNamespace(), obj.GetName()}
+	c.Lock()
+	target, ok := c.targets[key]
+	if !ok || !target.service {
+		c.Unlock()
+		return nil
+	}
+	uid, importName := target.uid, target.importName
+	c.Unlock()
+	if _, notOwned := withOwner(obj.GetOwnerReferences(), metav1.OwnerReference{UID: uid}); event != informer.EventDelete || importName != "" || notOwned {
+		c.notifyUpdate(key)
+		return nil
+	}
+	// the watch also reports Services that no longer match the label selector as deleted
+	service, err := c.serviceClient.Resource(c.serviceResource, key.namespace).Get(key.name, metav1.GetOptions{})
+	switch {
+	case err == nil && service.GetDeletionTimestamp() == nil:
+		c.notifyUpdate(key)
+		return nil
+	case err != nil && !errors.IsNotFound(err):
+		return fmt.Errorf("get deleted service: %v", err)
+	}
+	err = c.client.Resource(c.resource, key.namespace).Delete(key.name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+	switch {
+	case errors.IsNotFound(err) || errors.IsConflict(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("delete endpoints of service: %v", err)
+	}
+	c.logger.Printf("%s/%s: deleted with its service", key.namespace, key.name)
+	return nil
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/xiaopal/kube-informer/pkg/informer"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	ptypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_servicePorts(t *testing.T) {
+	single := []corev1.EndpointSubset{
+		{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+		{Addresses: []corev1.EndpointAddress{{IP: "2.2.2.2"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+	}
+	if nameServicePorts(single) || single[0].Ports[0].Name != "" {
+		t.Errorf("nameServicePorts() of a single port named it: %v", single)
+	}
+	if got, want := servicePorts(single), []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("servicePorts() = %v, want %v", got, want)
+	}
+
+	multi := []corev1.EndpointSubset{
+		{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}}, Ports: []corev1.EndpointPort{{Port: 443, Protocol: corev1.ProtocolTCP}, {Port: 53, Protocol: corev1.ProtocolUDP}}},
+		{Addresses: []corev1.EndpointAddress{{IP: "2.2.2.2"}}, Ports: []corev1.EndpointPort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}}},
+	}
+	if !nameServicePorts(multi) || nameServicePorts(multi) {
+		t.Errorf("nameServicePorts() want named once: %v", multi)
+	}
+	want := []corev1.ServicePort{
+		{Name: "udp-53", Protocol: corev1.ProtocolUDP, Port: 53, TargetPort: intstr.FromInt(53)},
+		{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80)},
+		{Name: "tcp-443", Protocol: corev1.ProtocolTCP, Port: 443, TargetPort: intstr.FromInt(443)},
+	}
+	if got := servicePorts(multi); !reflect.DeepEqual(got, want) {
+		t.Errorf("servicePorts() = %v, want %v", got, want)
+	}
+}
+
+func Test_withOwner(t *testing.T) {
+	refs := []metav1.OwnerReference{{Kind: "ExternalServiceImport", UID: "1"}}
+	if got, added := withOwner(refs, metav1.OwnerReference{Kind: "Service", UID: "2"}); !added || len(got) != 2 || len(refs) != 1 {
+		t.Errorf("withOwner() = %v, %v", got, added)
+	}
+	if got, added := withOwner(refs, metav1.OwnerReference{Kind: "ExternalServiceImport", UID: "1"}); added || len(got) != 1 {
+		t.Errorf("withOwner() of an existing owner = %v, %v", got, added)
+	}
+}
+
+func Test_jsonValue(t *testing.T) {
+	ports := []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80)}}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.Service{Spec: corev1.ServiceSpec{Ports: ports}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired, err := jsonValue(ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live, err := jsonValue(obj["spec"].(map[string]interface{})["ports"]); err != nil || !reflect.DeepEqual(desired, live) {
+		t.Errorf("jsonValue() of live ports = %v, want %v", live, desired)
+	}
+	ports[0].Port = 81
+	if changed, _ := jsonValue(ports); reflect.DeepEqual(desired, changed) {
+		t.Errorf("jsonValue() of changed ports = %v", changed)
+	}
+}
+
+func Test_endpointsImporter_handleServiceEvent(t *testing.T) {
+	c := &endpointsImporter{
+		logger:      log.New(ioutil.Discard, "", 0),
+		targets:     map[objectKey]*targetRecord{},
+		updateQueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.updateQueue.ShutDown()
+	key, imported := objectKey{"default", "test"}, objectKey{"default", "imported"}
+	c.targets[key] = &targetRecord{c: c, key: key, uid: "endpoints-uid", service: true}
+	c.targets[imported] = &targetRecord{c: c, key: imported, uid: "imported-uid", service: true, importName: "imported"}
+	service := func(key objectKey, owner string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetKind("Service")
+		obj.SetNamespace(key.namespace)
+		obj.SetName(key.name)
+		obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "v1", Kind: "Endpoints", Name: key.name, UID: ptypes.UID(owner)}})
+		return obj
+	}
+	for _, tt := range []struct {
+		name   string
+		event  informer.EventType
+		obj    *unstructured.Unstructured
+		notify bool
+	}{
+		{"update", informer.EventUpdate, service(key, "endpoints-uid"), true},
+		{"delete of another owner", informer.EventDelete, service(key, "other-uid"), true},
+		{"delete of an import", informer.EventDelete, service(imported, "imported-uid"), true},
+		{"unknown endpoints", informer.EventUpdate, service(objectKey{"default", "unknown"}, "endpoints-uid"), false},
+	} {
+		if err := c.handleServiceEvent(tt.event, tt.obj); err != nil {
+			t.Errorf("handleServiceEvent() of %s: %v", tt.name, err)
+		}
+		if got := c.updateQueue.Len() > 0; got != tt.notify {
+			t.Errorf("handleServiceEvent() of %s notified = %v, want %v", tt.name, got, tt.notify)
+		}
+		for c.updateQueue.Len() > 0 {
+			item, _ := c.updateQueue.Get()
+			c.updateQueue.Done(item)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	ptypes "k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// LabelServiceName label of EndpointSlices
+	LabelServiceName = "kubernetes.io/service-name"
+	// LabelManagedBy label of EndpointSlices
+	LabelManagedBy = "endpointslice.kubernetes.io/managed-by"
+	// LabelSkipMirror label of Endpoints
+	LabelSkipMirror = "endpointslice.kubernetes.io/skip-mirror"
+	// EndpointSliceManagedBy value of managed-by label
+	EndpointSliceManagedBy = "kube-service-importer.xiaopal.github.com"
+
+	maxEndpointsPerSlice = 100
+)
+
+type (
+	endpointSlice struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata,omitempty"`
+		AddressType       string              `json:"addressType"`
+		Endpoints         []sliceEndpoint     `json:"endpoints"`
+		Ports             []sliceEndpointPort `json:"ports"`
+	}
+	sliceEndpoint struct {
+		Addresses  []string                `json:"addresses"`
+		Conditions sliceEndpointConditions `json:"conditions"`
+		Hostname   *string                 `json:"hostname,omitempty"`
+		NodeName   *string                 `json:"nodeName,omitempty"`
+		TargetRef  *corev1.ObjectReference `json:"targetRef,omitempty"`
+	}
+	sliceEndpointConditions struct {
+		Ready       *bool `json:"ready,omitempty"`
+		Serving     *bool `json:"serving,omitempty"`
+		Terminating *bool `json:"terminating,omitempty"`
+	}
+	sliceEndpointPort struct {
+		Name        *string          `json:"name,omitempty"`
+		Port        *int32           `json:"port,omitempty"`
+		Protocol    *corev1.Protocol `json:"protocol,omitempty"`
+		AppProtocol *string          `json:"appProtocol,omitempty"`
+	}
+)
+
+func addressType(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func toSlicePorts(ports []corev1.EndpointPort) ([]sliceEndpointPort, string) {
+	slicePorts, signatures := make([]sliceEndpointPort, len(ports)), make([]string, len(ports))
+	for i := range ports {
+		port := ports[i]
+		slicePorts[i] = sliceEndpointPort{Name: &port.Name, Port: &port.Port, Protocol: &port.Protocol}
+		signatures[i] = fmt.Sprintf("%s:%d/%s", port.Name, port.Port, port.Protocol)
+	}
+	sort.Strings(signatures)
+	return slicePorts, strings.Join(signatures, ",")
+}
+
+func toSliceEndpoint(addr corev1.EndpointAddress, ready bool) sliceEndpoint {
+	endpoint := sliceEndpoint{
+		Addresses: []string{addr.IP},
+		Conditions: sliceEndpointConditions{
+			Ready:       boolPtr(ready),
+			Serving:     boolPtr(ready),
+			Terminating: boolPtr(false),
+		},
+		NodeName:  addr.NodeName,
+		TargetRef: addr.TargetRef,
+	}
+	if addr.Hostname != "" {
+		endpoint.Hostname = &addr.Hostname
+	}
+	return endpoint
+}
+
+func sliceName(name, addressType, signature string, index int) string {
+	h := fnv.New32a()
+	h.Write([]byte(signature))
+	return fmt.Sprintf("%s-%s-%08x-%d", name, strings.ToLower(addressType), h.Sum32(), index)
+}
+
+// buildEndpointSlices converts subsets to EndpointSlices grouped by ports and address type
+func buildEndpointSlices(key objectKey, owner *metav1.OwnerReference, subsets []corev1.EndpointSubset) []endpointSlice {
+	type sliceGroup struct {
+		addressType, signature string
+		ports                  []sliceEndpointPort
+		endpoints              []sliceEndpoint
+	}
+	groups, groupKeys := map[string]*sliceGroup{}, []string{}
+	appendEndpoint := func(ports []sliceEndpointPort, signature string, addr corev1.EndpointAddress, ready bool) {
+		addrType := addressType(addr.IP)
+		groupKey := addrType + "|" + signature
+		group, ok := groups[groupKey]
+		if !ok {
+			group = &sliceGroup{addressType: addrType, signature: signature, ports: ports}
+			groups[groupKey], groupKeys = group, append(groupKeys, groupKey)
+		}
+		group.endpoints = append(group.endpoints, toSliceEndpoint(addr, ready))
+	}
+	for _, subset := range subsets {
+		ports, signature := toSlicePorts(subset.Ports)
+		for _, addr := range subset.Addresses {
+			appendEndpoint(ports, signature, addr, true)
+		}
+		for _, addr := range subset.NotReadyAddresses {
+			appendEndpoint(ports, signature, addr, false)
+		}
+	}
+	slices := []endpointSlice{}
+	for _, groupKey := range groupKeys {
+		group := groups[groupKey]
+		for i := 0; i*maxEndpointsPerSlice < len(group.endpoints); i++ {
+			endpoints := group.endpoints[i*maxEndpointsPerSlice:]
+			if len(endpoints) > maxEndpointsPerSlice {
+				endpoints = endpoints[:maxEndpointsPerSlice]
+			}
+			slice := endpointSlice{
+				TypeMeta: metav1.TypeMeta{APIVersion: "discovery.k8s.io/v1", Kind: "EndpointSlice"},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      sliceName(key.name, group.addressType, group.signature, i),
+					Namespace: key.namespace,
+					Labels: map[string]string{
+						LabelServiceName: key.name,
+						LabelManagedBy:   EndpointSliceManagedBy,
+					},
+				},
+				AddressType: group.addressType,
+				Endpoints:   endpoints,
+				Ports:       group.ports,
+			}
+			if owner != nil {
+				slice.OwnerReferences = []metav1.OwnerReference{*owner}
+			}
+			slices = append(slices, slice)
+		}
+	}
+	return slices
+}
+
+// subsetsFromEndpointSlices restores subsets from EndpointSlices written by buildEndpointSlices
+func subsetsFromEndpointSlices(objs []unstructured.Unstructured) ([]corev1.EndpointSubset, error) {
+	subsets, subsetIndexes := []corev1.EndpointSubset{}, map[string]int{}
+	for _, obj := range objs {
+		slice := endpointSlice{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &slice); err != nil {
+			return nil, err
+		}
+		ports := make([]corev1.EndpointPort, 0, len(slice.Ports))
+		for _, port := range slice.Ports {
+			endpointPort := corev1.EndpointPort{Protocol: corev1.ProtocolTCP}
+			if port.Name != nil {
+				endpointPort.Name = *port.Name
+			}
+			if port.Port != nil {
+				endpointPort.Port = *port.Port
+			}
+			if port.Protocol != nil {
+				endpointPort.Protocol = *port.Protocol
+			}
+			ports = append(ports, endpointPort)
+		}
+		_, signature := toSlicePorts(ports)
+		index, ok := subsetIndexes[signature]
+		if !ok {
+			index, subsets = len(subsets), append(subsets, corev1.EndpointSubset{Ports: ports})
+			subsetIndexes[signature] = index
+		}
+		subset := &subsets[index]
+		for _, endpoint := range slice.Endpoints {
+			ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+			for _, ip := range endpoint.Addresses {
+				addr := corev1.EndpointAddress{IP: ip, NodeName: endpoint.NodeName, TargetRef: endpoint.TargetRef}
+				if endpoint.Hostname != nil {
+					addr.Hostname = *endpoint.Hostname
+				}
+				if ready {
+					subset.Addresses = append(subset.Addresses, addr)
+				} else {
+					subset.NotReadyAddresses = append(subset.NotReadyAddresses, addr)
+				}
+			}
+		}
+	}
+	return subsets, nil
+}
+
+func endpointSlicesSelector(key objectKey) string {
+	return fmt.Sprintf("%s=%s,%s=%s", LabelServiceName, key.name, LabelManagedBy, EndpointSliceManagedBy)
+}
+
+func (c *endpointsImporter) listEndpointSlices(key objectKey) ([]unstructured.Unstructured, error) {
+	list, err := c.sliceClient.Resource(c.sliceResource, key.namespace).List(metav1.ListOptions{LabelSelector: endpointSlicesSelector(key)})
+	if err != nil {
+		return nil, err
+	}
+	return list.(*unstructured.UnstructuredList).Items, nil
+}
+
+func (c *endpointsImporter) loadEndpointSlices(key objectKey) ([]corev1.EndpointSubset, error) {
+	objs, err := c.listEndpointSlices(key)
+	if err != nil {
+		return nil, err
+	}
+	return subsetsFromEndpointSlices(objs)
+}
+
+func (c *endpointsImporter) applyEndpointSlices(key objectKey, slices []endpointSlice) error {
+	client, applied := c.sliceClient.Resource(c.sliceResource, key.namespace), map[string]bool{}
+	for i := range slices {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&slices[i])
+		if err != nil {
+			return err
+		}
+		unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+		patch, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err = client.Patch(slices[i].Name, ptypes.MergePatchType, patch); errors.IsNotFound(err) {
+			_, err = client.Create(&unstructured.Unstructured{Object: obj})
+		}
+		if err != nil {
+			return fmt.Errorf("apply endpointslice %s: %v", slices[i].Name, err)
+		}
+		applied[slices[i].Name] = true
+	}
+	existing, err := c.listEndpointSlices(key)
+	if err != nil {
+		return err
+	}
+	for _, obj := range existing {
+		if name := obj.GetName(); !applied[name] {
+			if err := client.Delete(name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("delete endpointslice %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func setSliceAppProtocols(slices []endpointSlice, appProtocols map[string]string) {
+	for i := range slices {
+		for j := range slices[i].Ports {
+			port := &slices[i].Ports[j]
+			if appProtocol, ok := appProtocols[appProtocolKey(*port.Name, *port.Port, *port.Protocol)]; ok {
+				port.AppProtocol = &appProtocol
+			}
+		}
+	}
+}
+
+// endpointSlicesWrite applies the EndpointSlices of the subsets if changed
+func (h *targetRecord) endpointSlicesWrite(subsets []corev1.EndpointSubset) (targetWrite, error) {
+	slices := buildEndpointSlices(h.key, h.owner(), subsets)
+	setSliceAppProtocols(slices, h.appProtocols())
+	data, err := json.Marshal(slices)
+	if err != nil {
+		return targetWrite{}, err
+	}
+	published, key, c := string(data), h.key, h.c
+	write := targetWrite{done: func(err error) error {
+		if err != nil {
+			h.publishedSlices = ""
+			return nil
+		}
+		h.publishedSlices = published
+		if !c.Output.Endpoints() {
+			// endpointslices are the only output, so the published subsets become the base of the next pass
+			hostsChanged := !reflect.DeepEqual(hostItems(h.lastSubsets()), hostItems(subsets))
+			h.updateSubsets(subsets)
+			if hostsChanged {
+				if _, err := h.updateProbes(h.probeConfs); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}}
+	if published != h.publishedSlices {
+		write.write = func() error {
+			err := c.applyEndpointSlices(key, slices)
+			c.metrics.patched(key, "endpointslices", err)
+			if err == nil {
+				c.logger.Printf("%s/%s: endpointslices updated", key.namespace, key.name)
+			}
+			return err
+		}
+	}
+	return write, nil
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+func Test_buildEndpointSlices(t *testing.T) {
+	key, ports, node := objectKey{"default", "test"}, []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}, "node-1"
+	subsets := []corev1.EndpointSubset{
+		{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1", Hostname: "one", NodeName: &node}, {IP: "::1"}}, NotReadyAddresses: []corev1.EndpointAddress{{IP: "2.2.2.2"}}, Ports: ports},
+	}
+	slices := buildEndpointSlices(key, nil, subsets)
+	if len(slices) != 2 {
+		t.Fatalf("buildEndpointSlices() = %v slices, want 2", len(slices))
+	}
+	if got, want := slices[0].AddressType, "IPv4"; got != want {
+		t.Errorf("addressType = %v, want %v", got, want)
+	}
+	if got, want := len(slices[0].Endpoints), 2; got != want {
+		t.Errorf("ipv4 endpoints = %v, want %v", got, want)
+	}
+	if ready := slices[0].Endpoints[1].Conditions.Ready; ready == nil || *ready {
+		t.Errorf("2.2.2.2 ready = %v, want false", ready)
+	}
+	if got, want := slices[1].AddressType, "IPv6"; got != want {
+		t.Errorf("addressType = %v, want %v", got, want)
+	}
+	if got, want := slices[0].Labels[LabelServiceName], "test"; got != want {
+		t.Errorf("service-name = %v, want %v", got, want)
+	}
+
+	objs := make([]unstructured.Unstructured, len(slices))
+	for i := range slices {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&slices[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs[i].Object = obj
+	}
+	got, err := subsetsFromEndpointSlices(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []corev1.EndpointSubset{
+		{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1", Hostname: "one", NodeName: &node}, {IP: "::1"}}, NotReadyAddresses: []corev1.EndpointAddress{{IP: "2.2.2.2"}}, Ports: ports},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("subsetsFromEndpointSlices() = %v, want %v", got, want)
+	}
+}
+
+func Test_buildEndpointSlices_chunks(t *testing.T) {
+	addrs := make([]corev1.EndpointAddress, maxEndpointsPerSlice+1)
+	for i := range addrs {
+		addrs[i] = corev1.EndpointAddress{IP: "10.0.0.1"}
+	}
+	slices := buildEndpointSlices(objectKey{"default", "test"}, nil, []corev1.EndpointSubset{
+		{Addresses: addrs, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+	})
+	if len(slices) != 2 || len(slices[1].Endpoints) != 1 || slices[0].Name == slices[1].Name {
+		t.Errorf("buildEndpointSlices() = %v slices", len(slices))
+	}
+}
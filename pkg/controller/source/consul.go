@@ -0,0 +1,197 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type (
+	// consulServiceEntry is an instance of /v1/health/service/:service
+	consulServiceEntry struct {
+		Node struct {
+			Node    string
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	// consulQuery is the state of blocking queries
+	consulQuery struct {
+		index   uint64
+		errors  int
+		results []LoadResult
+	}
+)
+
+// consulResults maps addresses of instances (of the service, or the node) to ips with ports of the instances,
+// or port= if given; instances of host names or without ports are skipped
+func consulResults(entries []consulServiceEntry, port, protocol string, overwrite bool, logger *log.Logger) ([]LoadResult, error) {
+	ips, ipPorts, addresses := []string{}, map[string]string{}, map[string]corev1.EndpointAddress{}
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		ip, skip := net.ParseIP(address), ""
+		switch {
+		case ip == nil:
+			skip = fmt.Sprintf("illegal ip %q", address)
+		case port == "" && (entry.Service.Port <= 0 || entry.Service.Port > 65535):
+			skip = fmt.Sprintf("illegal port %d", entry.Service.Port)
+		}
+		if skip != "" {
+			if logger != nil {
+				logger.Printf("consul: skip instance of node %s: %s", entry.Node.Node, skip)
+			}
+			continue
+		}
+		if stringsIndex(ips, ip.String()) < 0 {
+			ips = append(ips, ip.String())
+			addresses[ip.String()] = corev1.EndpointAddress{IP: ip.String(), Hostname: hostnameLabel(entry.Node.Node)}
+		}
+		if port == "" {
+			if ipPorts[ip.String()] != "" {
+				ipPorts[ip.String()] += ","
+			}
+			ipPorts[ip.String()] += strconv.Itoa(entry.Service.Port)
+		}
+	}
+	results, err := portSetResults(ips, ipPorts, port, protocol)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Addresses, results[i].Overwrite = addresses, overwrite
+	}
+	return results, nil
+}
+
+// consulSourceLoader imports instances of service= from the health endpoint of the Consul agent of url=,
+// filtered by tag= (repeated for each tag), dc= and passing-only= (defaults to yes);
+// each load is a blocking query of up to wait= (defaults to 5m, within timeout=) returning once instances change
+func consulSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
+	rawURL, service, port, protocol, overwrite := strings.TrimSuffix(conf.GetString("url", "http://127.0.0.1:8500"), "/"),
+		conf.GetString("service", ""),
+		conf.GetString("port", ""),
+		strings.ToUpper(conf.GetString("protocol", "TCP")),
+		conf.GetBool("overwrite", false)
+	wait, allowEmpty := conf.GetDuration("wait", 5*time.Minute), conf.GetBool("allow-empty", false)
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("illegal url %q", rawURL)
+	}
+	if service == "" {
+		return nil, "", fmt.Errorf("illegal consul %v: service required", conf)
+	}
+	// validates port= if given, and protocol=
+	if _, err := parseProtocolPorts(conf.GetString("port", "1"), protocol); err != nil {
+		return nil, "", err
+	}
+	query := url.Values{}
+	if conf.GetBool("passing-only", true) {
+		query.Set("passing", "1")
+	}
+	for _, tag := range conf.GetStrings("tag") {
+		query.Add("tag", tag)
+	}
+	if dc, ok := conf["dc"]; ok {
+		query.Set("dc", dc)
+	}
+	header, err := prober.LoadHeader(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	if token, ok := conf["token"]; ok {
+		header.Set("X-Consul-Token", token)
+	}
+	tlsConfig, err := prober.LoadTLSConfig(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	client, state := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}, &consulQuery{}
+	// loads are sequential, see prober.StatusUpdater, so the state is not locked
+	return func(ctx context.Context, timeout time.Duration, logger *log.Logger) ([]LoadResult, error) {
+		if err := backoff(ctx, state.errors); err != nil {
+			return nil, err
+		}
+		entries, index, err := consulHealthService(ctx, client, rawURL, service, query, header, state.index, wait, timeout)
+		if err != nil {
+			state.errors++
+			return nil, err
+		}
+		state.errors = 0
+		// the index may go backwards, eg. on restarts of Consul, which resets blocking queries
+		if index < state.index {
+			index = 0
+		}
+		if index == state.index && state.results != nil {
+			return state.results, nil
+		}
+		results, err := consulResults(entries, port, protocol, overwrite, logger)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("consul %s: %v", service, err)
+		case len(results) == 0 && !allowEmpty:
+			state.index, state.results = index, nil
+			return nil, fmt.Errorf("consul %s: no instances", service)
+		}
+		state.index, state.results = index, results
+		return results, nil
+	}, fmt.Sprintf("consul|%s/%s?%s:%s/%s", rawURL, service, query.Encode(), port, protocol), nil
+}
+
+// consulHealthService is a blocking query of instances newer than index, waiting within timeout
+func consulHealthService(ctx context.Context, client *http.Client, rawURL, service string, query url.Values, header http.Header,
+	index uint64, wait, timeout time.Duration) ([]consulServiceEntry, uint64, error) {
+	params := url.Values{}
+	for key, vals := range query {
+		params[key] = vals
+	}
+	if index > 0 {
+		// Consul adds up to wait/16 of jitter
+		if timeout > 0 && wait > timeout*3/4 {
+			wait = timeout * 3 / 4
+		}
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", wait/time.Millisecond))
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/health/service/%s?%s", rawURL, url.PathEscape(service), params.Encode()), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header.Clone()
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, 0, fmt.Errorf("consul %s: %s %s", service, res.Status, strings.TrimSpace(string(message)))
+	}
+	entries := []consulServiceEntry{}
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("consul %s: %v", service, err)
+	}
+	newIndex, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul %s: illegal X-Consul-Index %q", service, res.Header.Get("X-Consul-Index"))
+	}
+	return entries, newIndex, nil
+}
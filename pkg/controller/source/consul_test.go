@@ -0,0 +1,114 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+// fakeConsul serves /v1/health/service/:service of instances, blocking queries until instances change
+type fakeConsul struct {
+	sync.Mutex
+	index     uint64
+	instances string
+	changed   chan struct{}
+	queries   []string
+}
+
+func (c *fakeConsul) set(instances string) {
+	c.Lock()
+	defer c.Unlock()
+	c.index, c.instances = c.index+1, instances
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	c.Lock()
+	index, changed := c.index, c.changed
+	c.queries = append(c.queries, req.URL.RequestURI())
+	c.Unlock()
+	if req.URL.Path != "/v1/health/service/web" || req.Header.Get("X-Consul-Token") != "secret" {
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if req.URL.Query().Get("index") == fmt.Sprint(index) {
+		wait, _ := time.ParseDuration(req.URL.Query().Get("wait"))
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	res.Header().Set("X-Consul-Index", fmt.Sprint(c.index))
+	res.Write([]byte(c.instances))
+}
+
+func Test_consulSourceLoader(t *testing.T) {
+	consul := &fakeConsul{index: 10, changed: make(chan struct{}), instances: `[
+		{"Node": {"Node": "vm-1", "Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8080}},
+		{"Node": {"Node": "vm-2", "Address": "10.0.0.2"}, "Service": {"Address": "10.0.1.2", "Port": 8080}},
+		{"Node": {"Node": "vm-2", "Address": "10.0.0.2"}, "Service": {"Address": "10.0.1.2", "Port": 8081}},
+		{"Node": {"Node": "vm-3", "Address": "vm-3.example.com"}, "Service": {"Port": 8080}}
+	]`}
+	ts := httptest.NewServer(consul)
+	defer ts.Close()
+	conf := fluconf.Config{"url": ts.URL, "service": "web", "tag": "v1\nprimary", "dc": "dc1", "token": "secret", "wait": "1s"}
+	load, name, err := consulSourceLoader(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "consul|" + ts.URL + "/web?dc=dc1&passing=1&tag=v1&tag=primary:/TCP"; name != want {
+		t.Errorf("name = %q, want %q", name, want)
+	}
+	got, err := load(context.Background(), 10*time.Second, nil)
+	want := []LoadResult{
+		{IPs: []string{"10.0.0.1"}, Ports: []int{8080}, PortNames: map[int]string{}, Protocol: "TCP"},
+		{IPs: []string{"10.0.1.2"}, Ports: []int{8080, 8081}, PortNames: map[int]string{}, Protocol: "TCP"},
+	}
+	if err != nil || len(got) != 2 || got[0].Addresses["10.0.0.1"].Hostname != "vm-1" {
+		t.Fatalf("load() = %v, %v", got, err)
+	}
+	for i := range got {
+		got[i].Addresses = nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("load() = %v, want %v", got, want)
+	}
+
+	// unchanged instances block until the wait, and are not reprocessed
+	start := time.Now()
+	if got, err := load(context.Background(), 10*time.Second, nil); err != nil || len(got) != 2 || time.Since(start) < time.Second {
+		t.Errorf("load() of unchanged = %v, %v after %v", got, err, time.Since(start))
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		consul.set(`[{"Node": {"Node": "vm-1", "Address": "10.0.0.1"}, "Service": {"Port": 9090}}]`)
+	}()
+	start = time.Now()
+	got, err = load(context.Background(), 10*time.Second, nil)
+	if err != nil || len(got) != 1 || !reflect.DeepEqual(got[0].Ports, []int{9090}) || time.Since(start) >= time.Second {
+		t.Errorf("load() of changed = %v, %v after %v", got, err, time.Since(start))
+	}
+	consul.Lock()
+	if query := consul.queries[len(consul.queries)-1]; query != "/v1/health/service/web?dc=dc1&index=10&passing=1&tag=v1&tag=primary&wait=1000ms" {
+		t.Errorf("query = %v", query)
+	}
+	consul.Unlock()
+
+	consul.set(`[]`)
+	if _, err := load(context.Background(), 10*time.Second, nil); err == nil {
+		t.Errorf("load() of no instances want error")
+	}
+	if _, _, err := consulSourceLoader(fluconf.Config{"url": ts.URL}); err == nil {
+		t.Errorf("consulSourceLoader() without service want error")
+	}
+}
@@ -0,0 +1,267 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+)
+
+type (
+	// etcdKeyValue is a key of the gRPC gateway, bytes are base64 in JSON
+	etcdKeyValue struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	}
+	// etcdWatchResponse is a message of watch streams of the gRPC gateway
+	etcdWatchResponse struct {
+		Result *struct {
+			Created      bool              `json:"created"`
+			Canceled     bool              `json:"canceled"`
+			CancelReason string            `json:"cancel_reason"`
+			Events       []json.RawMessage `json:"events"`
+		} `json:"result"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	// etcdClient is a client of keys of prefix of the gRPC gateway (/v3, or /v3beta of etcd 3.3) of endpoints
+	etcdClient struct {
+		endpoints          []string
+		api                string
+		username, password string
+		header             http.Header
+		client             *http.Client
+		key, rangeEnd      []byte
+	}
+)
+
+// etcdPrefixEnd is the range end of keys of prefix, as clientv3.GetPrefixRangeEnd
+func etcdPrefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// loadEtcdClient loads a client of prefix= of endpoints= (defaults to http://127.0.0.1:2379), authenticated by
+// username= and password=, with header= and TLS options of https probes
+func loadEtcdClient(conf fluconf.Config) (*etcdClient, error) {
+	c := &etcdClient{
+		api:      "/" + strings.Trim(conf.GetString("api", "v3"), "/"),
+		username: conf.GetString("username", ""),
+		password: conf.GetString("password", ""),
+		key:      []byte(conf.GetString("prefix", "")),
+	}
+	for _, endpoint := range strings.Split(conf.GetString("endpoints", "http://127.0.0.1:2379"), ",") {
+		endpoint = strings.TrimSuffix(strings.TrimSpace(endpoint), "/")
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("illegal endpoint %q", endpoint)
+		}
+		c.endpoints = append(c.endpoints, endpoint)
+	}
+	if len(c.key) == 0 {
+		return nil, fmt.Errorf("illegal etcd %v: prefix required", conf)
+	}
+	c.rangeEnd = etcdPrefixEnd(c.key)
+	header, err := prober.LoadHeader(conf)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := prober.LoadTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	c.header, c.client = header, &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}
+	return c, nil
+}
+
+// post requests path of endpoint, authenticated by a token of username if given
+func (c *etcdClient) post(ctx context.Context, endpoint, path string, body interface{}, authenticate bool) (*http.Response, error) {
+	header := c.header.Clone()
+	if authenticate && c.username != "" {
+		auth := struct {
+			Token string `json:"token"`
+		}{}
+		res, err := c.post(ctx, endpoint, "/auth/authenticate", map[string]string{"name": c.username, "password": c.password}, false)
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(res.Body).Decode(&auth)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: authenticate: %v", endpoint, err)
+		}
+		header.Set("Authorization", auth.Token)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint+c.api+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("%s%s: %s %s", endpoint, path, res.Status, strings.TrimSpace(string(message)))
+	}
+	return res, nil
+}
+
+// rangePrefix gets keys of prefix from the first available endpoint
+func (c *etcdClient) rangePrefix(ctx context.Context) ([]etcdKeyValue, error) {
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		res, err := c.post(ctx, endpoint, "/kv/range", map[string][]byte{"key": c.key, "range_end": c.rangeEnd}, true)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer res.Body.Close()
+		ranged := struct {
+			Kvs []etcdKeyValue `json:"kvs"`
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(&ranged); err != nil {
+			return nil, fmt.Errorf("%s: %v", endpoint, err)
+		}
+		return ranged.Kvs, nil
+	}
+	return nil, lastErr
+}
+
+// watchPrefix watches keys of prefix on endpoint, notifying once created and on events, until the stream ends
+func (c *etcdClient) watchPrefix(ctx context.Context, endpoint string, notify func()) (created bool, err error) {
+	res, err := c.post(ctx, endpoint, "/watch", map[string]interface{}{
+		"create_request": map[string][]byte{"key": c.key, "range_end": c.rangeEnd},
+	}, true)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	for decoder := json.NewDecoder(res.Body); ; {
+		watched := etcdWatchResponse{}
+		if err := decoder.Decode(&watched); err != nil {
+			return created, fmt.Errorf("%s: watch: %v", endpoint, err)
+		}
+		switch result := watched.Result; {
+		case watched.Error != nil:
+			return created, fmt.Errorf("%s: watch: %s", endpoint, watched.Error.Message)
+		case result == nil:
+		case result.Canceled:
+			return created, fmt.Errorf("%s: watch canceled: %s", endpoint, result.CancelReason)
+		case result.Created || len(result.Events) > 0:
+			// changes between loads and creating the watch are missed, so it is loaded once created
+			created = true
+			notify()
+		}
+	}
+}
+
+// etcdSourceLoader imports records of keys of prefix= of etcd v3, see loadEtcdClient, with values of format=lines of ip[:port],
+// or format=json of entries of the file source, selected by jsonpath=, ip-path=, port-path= and hostname-path= as of http sources;
+// illegal records are skipped, and changes are watched, see etcdSourceWatch
+func etcdSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
+	port, protocol, overwrite := conf.GetString("port", ""),
+		strings.ToUpper(conf.GetString("protocol", "TCP")),
+		conf.GetBool("overwrite", false)
+	format, allowEmpty := strings.ToLower(conf.GetString("format", "lines")), conf.GetBool("allow-empty", false)
+	client, err := loadEtcdClient(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	if port != "" {
+		if _, err := parseProtocolPorts(port, protocol); err != nil {
+			return nil, "", err
+		}
+	}
+	var parse func([]byte) ([]fileEntry, error)
+	switch format {
+	case "lines":
+		parse = func(value []byte) ([]fileEntry, error) {
+			return parseFileEntries(value, "lines")
+		}
+	case "json":
+		extract, err := loadHTTPExtractor(conf)
+		if err != nil {
+			return nil, "", err
+		}
+		parse = func(value []byte) ([]fileEntry, error) {
+			doc, err := decodeHTTPDocument(value)
+			if err != nil {
+				return nil, err
+			}
+			return extract(doc)
+		}
+	default:
+		return nil, "", fmt.Errorf("illegal format %v", format)
+	}
+	return func(ctx context.Context, timeout time.Duration, logger *log.Logger) ([]LoadResult, error) {
+		kvs, err := client.rangePrefix(ctx)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]sourceRecord, 0, len(kvs))
+		for _, kv := range kvs {
+			records = append(records, sourceRecord{Key: string(kv.Key), Value: kv.Value})
+		}
+		entries := recordEntries(records, parse, port, protocol, logger)
+		if len(entries) == 0 && !allowEmpty {
+			return nil, fmt.Errorf("etcd %s: no records", client.key)
+		}
+		return fileResults(entries, port, protocol, overwrite)
+	}, fmt.Sprintf("etcd|%s%s:%s/%s", strings.Join(client.endpoints, ","), client.key, port, protocol), nil
+}
+
+// etcdSourceWatch notifies changes of keys of prefix= by watches of endpoints in turn, which are retried with backoff
+func etcdSourceWatch(conf fluconf.Config) WatchFunc {
+	return func(ctx context.Context, logger *log.Logger) <-chan struct{} {
+		client, err := loadEtcdClient(conf)
+		if err != nil {
+			logger.Printf("watch etcd: %v", err)
+			return nil
+		}
+		changes := make(chan struct{}, 1)
+		notify := func() {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+		go func() {
+			for i, errors := 0, 0; backoff(ctx, errors) == nil; i = (i + 1) % len(client.endpoints) {
+				created, err := client.watchPrefix(ctx, client.endpoints[i], notify)
+				if ctx.Err() != nil {
+					return
+				}
+				if errors++; created {
+					errors = 1
+				}
+				logger.Printf("watch etcd %s: %v", client.key, err)
+			}
+		}()
+		return changes
+	}
+}
@@ -0,0 +1,150 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+// fakeEtcd serves range, watch and authenticate of the gRPC gateway of kvs
+type fakeEtcd struct {
+	sync.Mutex
+	kvs     map[string]string
+	changed chan struct{}
+}
+
+func (e *fakeEtcd) put(key, value string) {
+	e.Lock()
+	defer e.Unlock()
+	e.kvs[key] = value
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+func (e *fakeEtcd) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v3/auth/authenticate" {
+		json.NewEncoder(res).Encode(map[string]string{"token": "token-1"})
+		return
+	}
+	if req.Header.Get("Authorization") != "token-1" {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body := struct {
+		Key           []byte `json:"key"`
+		RangeEnd      []byte `json:"range_end"`
+		CreateRequest *struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		} `json:"create_request"`
+	}{}
+	json.NewDecoder(req.Body).Decode(&body)
+	switch req.URL.Path {
+	case "/v3/kv/range":
+		e.Lock()
+		kvs := []etcdKeyValue{}
+		for key, value := range e.kvs {
+			if key >= string(body.Key) && key < string(body.RangeEnd) {
+				kvs = append(kvs, etcdKeyValue{Key: []byte(key), Value: []byte(value)})
+			}
+		}
+		e.Unlock()
+		sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+		json.NewEncoder(res).Encode(map[string]interface{}{"kvs": kvs})
+	case "/v3/watch":
+		e.Lock()
+		changed := e.changed
+		e.Unlock()
+		json.NewEncoder(res).Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+		res.(http.Flusher).Flush()
+		select {
+		case <-changed:
+			json.NewEncoder(res).Encode(map[string]interface{}{"result": map[string]interface{}{"events": []interface{}{map[string]string{}}}})
+		case <-req.Context().Done():
+		}
+	default:
+		res.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func Test_etcdPrefixEnd(t *testing.T) {
+	for prefix, want := range map[string]string{"/services/foo/": "/services/foo0", "a\xff": "b", "\xff\xff": "\x00"} {
+		if got := string(etcdPrefixEnd([]byte(prefix))); got != want {
+			t.Errorf("etcdPrefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func Test_etcdSourceLoader(t *testing.T) {
+	etcd := &fakeEtcd{changed: make(chan struct{}), kvs: map[string]string{
+		"/services/foo/1": "10.0.0.1:8080",
+		"/services/foo/2": "10.0.0.2:8080",
+		"/services/foo/3": "10.0.0.2:8081",
+		"/services/foo/4": "illegal",
+		"/services/fooo":  "10.0.0.4:8080",
+		"/services/bar/1": `{"address": "10.0.1.1", "port": 9090}`,
+		"/services/bar/2": `{"address": "10.0.1.2"}`,
+	}}
+	ts := httptest.NewServer(etcd)
+	defer ts.Close()
+	conf := fluconf.Config{"endpoints": "http://127.0.0.1:1," + ts.URL, "prefix": "/services/foo/", "username": "root", "password": "secret"}
+	load, name, err := etcdSourceLoader(conf)
+	if err != nil || name != "etcd|http://127.0.0.1:1,"+ts.URL+"/services/foo/:/TCP" {
+		t.Fatalf("etcdSourceLoader() = %q, %v", name, err)
+	}
+	got, err := load(context.Background(), 0, nil)
+	want := []LoadResult{
+		{IPs: []string{"10.0.0.1"}, Ports: []int{8080}, PortNames: map[int]string{}, Protocol: "TCP"},
+		{IPs: []string{"10.0.0.2"}, Ports: []int{8080, 8081}, PortNames: map[int]string{}, Protocol: "TCP"},
+	}
+	for i := range got {
+		got[i].Addresses = nil
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("load() = %v, %v, want %v", got, err, want)
+	}
+
+	load, _, err = etcdSourceLoader(fluconf.Config{"endpoints": ts.URL, "prefix": "/services/bar/", "format": "json",
+		"ip-path": "{.address}", "username": "root", "port": "80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = load(context.Background(), 0, nil)
+	if err != nil || len(got) != 2 || !reflect.DeepEqual(got[0].IPs, []string{"10.0.1.1"}) || !reflect.DeepEqual(got[1].Ports, []int{80}) {
+		t.Errorf("load(json) = %v, %v", got, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := etcdSourceWatch(fluconf.Config{"endpoints": ts.URL, "prefix": "/services/foo/", "username": "root"})(ctx, log.New(ioutil.Discard, "", 0))
+	for _, change := range []func(){func() {}, func() { etcd.put("/services/foo/5", "10.0.0.5:8080") }} {
+		change()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch not notified")
+		}
+	}
+
+	for _, invalid := range []fluconf.Config{
+		{},
+		{"prefix": "/services/foo/", "endpoints": "127.0.0.1:2379"},
+		{"prefix": "/services/foo/", "format": "xml"},
+		{"prefix": "/services/foo/", "port": "http"},
+	} {
+		if _, _, err := etcdSourceLoader(invalid); err == nil || !strings.Contains(err.Error(), "illegal") {
+			t.Errorf("etcdSourceLoader(%v) want error, got %v", invalid, err)
+		}
+	}
+}
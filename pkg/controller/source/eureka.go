@@ -0,0 +1,181 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+)
+
+type (
+	// eurekaApplication is the response of /apps/:app
+	eurekaApplication struct {
+		Application struct {
+			Instance eurekaInstances `json:"instance"`
+		} `json:"application"`
+	}
+	// eurekaInstances is a list of instances, or an instance if only one
+	eurekaInstances []eurekaInstance
+	eurekaInstance  struct {
+		InstanceID string            `json:"instanceId"`
+		HostName   string            `json:"hostName"`
+		IPAddr     string            `json:"ipAddr"`
+		Status     string            `json:"status"`
+		Port       eurekaPort        `json:"port"`
+		SecurePort eurekaPort        `json:"securePort"`
+		Metadata   map[string]string `json:"metadata"`
+	}
+	// eurekaPort is a port with @enabled of "true" or true
+	eurekaPort struct {
+		Port    filePort    `json:"$"`
+		Enabled interface{} `json:"@enabled"`
+	}
+)
+
+func (i *eurekaInstances) UnmarshalJSON(data []byte) error {
+	var instances []eurekaInstance
+	if err := json.Unmarshal(data, &instances); err == nil {
+		*i = instances
+		return nil
+	}
+	instance := eurekaInstance{}
+	if err := json.Unmarshal(data, &instance); err != nil {
+		return err
+	}
+	*i = eurekaInstances{instance}
+	return nil
+}
+
+func (p eurekaPort) enabled() bool {
+	return fmt.Sprint(p.Enabled) == "true"
+}
+
+// eurekaEntry is the address of an instance, with securePort if secure or the port of metadata portMetadata if given,
+// and hostName if not an ip
+func eurekaEntry(instance eurekaInstance, secure bool, portMetadata string) (fileEntry, error) {
+	entry, port := fileEntry{IP: instance.IPAddr}, instance.Port
+	if secure {
+		port = instance.SecurePort
+	}
+	switch {
+	case portMetadata != "":
+		val, ok := instance.Metadata[portMetadata]
+		if !ok {
+			return entry, fmt.Errorf("no metadata %s", portMetadata)
+		}
+		entry.Port = filePort(val)
+	case !port.enabled():
+		return entry, fmt.Errorf("port disabled")
+	default:
+		entry.Port = port.Port
+	}
+	if net.ParseIP(instance.HostName) == nil {
+		entry.Hostname = hostnameLabel(instance.HostName)
+	}
+	return entry, nil
+}
+
+// eurekaSourceLoader imports instances of app= from the first available of url= (comma separated service urls,
+// defaults to http://127.0.0.1:8761/eureka), with header= and TLS options of https probes; instances are filtered
+// by status= (comma separated, defaults to UP) and metadata.<key>=, with the port, or the secure port if secure=yes,
+// or the port of metadata port-metadata= if given
+func eurekaSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
+	app, port, protocol, overwrite := conf.GetString("app", ""),
+		conf.GetString("port", ""),
+		strings.ToUpper(conf.GetString("protocol", "TCP")),
+		conf.GetBool("overwrite", false)
+	secure, portMetadata, allowEmpty := conf.GetBool("secure", false), conf.GetString("port-metadata", ""), conf.GetBool("allow-empty", false)
+	statuses := strings.Split(strings.ToUpper(conf.GetString("status", "UP")), ",")
+	urls := []string{}
+	for _, rawURL := range strings.Split(conf.GetString("url", "http://127.0.0.1:8761/eureka"), ",") {
+		rawURL = strings.TrimSuffix(strings.TrimSpace(rawURL), "/")
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, "", fmt.Errorf("illegal url %q", rawURL)
+		}
+		urls = append(urls, rawURL)
+	}
+	if app == "" {
+		return nil, "", fmt.Errorf("illegal eureka %v: app required", conf)
+	}
+	if port != "" {
+		if _, err := parseProtocolPorts(port, protocol); err != nil {
+			return nil, "", err
+		}
+	}
+	query := url.Values{"status": statuses}
+	if secure {
+		query.Set("secure", "yes")
+	}
+	if portMetadata != "" {
+		query.Set("port-metadata", portMetadata)
+	}
+	selector := loadMetadataSelector(conf, query)
+	header, err := prober.LoadHeader(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	if header.Get("Accept") == "" {
+		header.Set("Accept", "application/json")
+	}
+	tlsConfig, err := prober.LoadTLSConfig(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}
+	return func(ctx context.Context, timeout time.Duration, logger *log.Logger) ([]LoadResult, error) {
+		application, err := (*eurekaApplication)(nil), error(nil)
+		for _, rawURL := range urls {
+			if application, err = eurekaGetApplication(ctx, client, rawURL+"/apps/"+url.PathEscape(app), header); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries := newSourceEntries(port, protocol, logger)
+		for _, instance := range application.Application.Instance {
+			if stringsIndex(statuses, instance.Status) < 0 || !matchMetadata(selector, instance.Metadata) {
+				continue
+			}
+			entry, err := eurekaEntry(instance, secure, portMetadata)
+			entries.add(instance.InstanceID, []fileEntry{entry}, err)
+		}
+		if len(entries.entries) == 0 && !allowEmpty {
+			return nil, fmt.Errorf("eureka %s: no instances", app)
+		}
+		return fileResults(entries.entries, port, protocol, overwrite)
+	}, fmt.Sprintf("eureka|%s/%s?%s:%s/%s", strings.Join(urls, ","), app, query.Encode(), port, protocol), nil
+}
+
+func eurekaGetApplication(ctx context.Context, client *http.Client, rawURL string, header http.Header) (*eurekaApplication, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header.Clone()
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("%s: %s %s", rawURL, res.Status, strings.TrimSpace(string(message)))
+	}
+	application := &eurekaApplication{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxHTTPSourceBody)).Decode(application); err != nil {
+		return nil, fmt.Errorf("%s: %v", rawURL, err)
+	}
+	return application, nil
+}
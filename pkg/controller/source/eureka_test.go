@@ -0,0 +1,73 @@
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+func Test_eurekaSourceLoader(t *testing.T) {
+	application := `{"application": {"name": "FOO", "instance": [
+		{"instanceId": "foo-1", "hostName": "foo-1.example.com", "ipAddr": "10.0.0.1", "status": "UP", "port": {"$": 8080, "@enabled": "true"},
+			"securePort": {"$": 8443, "@enabled": "true"}, "metadata": {"zone": "a", "management.port": "9090"}},
+		{"instanceId": "foo-2", "hostName": "10.0.0.2", "ipAddr": "10.0.0.2", "status": "UP", "port": {"$": 8080, "@enabled": "true"},
+			"securePort": {"$": 443, "@enabled": "false"}, "metadata": {"zone": "b"}},
+		{"instanceId": "foo-3", "hostName": "10.0.0.3", "ipAddr": "10.0.0.3", "status": "OUT_OF_SERVICE", "port": {"$": 8080, "@enabled": "true"}},
+		{"instanceId": "foo-4", "hostName": "foo-4", "ipAddr": "foo-4", "status": "UP", "port": {"$": 8080, "@enabled": "true"}}
+	]}}`
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Header.Get("Accept") != "application/json":
+			res.WriteHeader(http.StatusNotAcceptable)
+		case req.URL.Path == "/eureka/apps/FOO":
+			res.Write([]byte(application))
+		case req.URL.Path == "/eureka/apps/BAR":
+			res.Write([]byte(`{"application": {"name": "BAR", "instance": {"instanceId": "bar-1", "ipAddr": "10.0.1.1", "status": "UP", "port": {"$": "80", "@enabled": true}}}}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	for _, c := range []struct {
+		conf fluconf.Config
+		want []LoadResult
+	}{
+		{fluconf.Config{"app": "FOO"}, []LoadResult{{IPs: []string{"10.0.0.1", "10.0.0.2"}, Ports: []int{8080}, PortNames: map[int]string{}, Protocol: "TCP"}}},
+		{fluconf.Config{"app": "FOO", "secure": "yes"}, []LoadResult{{IPs: []string{"10.0.0.1"}, Ports: []int{8443}, PortNames: map[int]string{}, Protocol: "TCP"}}},
+		{fluconf.Config{"app": "FOO", "status": "up,out_of_service", "metadata.zone": "b"}, []LoadResult{{IPs: []string{"10.0.0.2"}, Ports: []int{8080}, PortNames: map[int]string{}, Protocol: "TCP"}}},
+		{fluconf.Config{"app": "FOO", "port-metadata": "management.port"}, []LoadResult{{IPs: []string{"10.0.0.1"}, Ports: []int{9090}, PortNames: map[int]string{}, Protocol: "TCP"}}},
+		{fluconf.Config{"app": "BAR"}, []LoadResult{{IPs: []string{"10.0.1.1"}, Ports: []int{80}, PortNames: map[int]string{}, Protocol: "TCP"}}},
+		{fluconf.Config{"app": "FOO", "metadata.zone": "c"}, nil},
+		{fluconf.Config{"app": "BAZ"}, nil},
+	} {
+		conf := c.conf.CopyWith("url", "http://127.0.0.1:1/eureka,"+ts.URL+"/eureka/")
+		load, _, err := eurekaSourceLoader(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := load(context.Background(), 0, nil)
+		for i := range got {
+			got[i].Addresses = nil
+		}
+		if (err != nil) != (c.want == nil) || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("load(%v) = %v, %v, want %v", conf, got, err, c.want)
+		}
+	}
+
+	load, name, err := eurekaSourceLoader(fluconf.Config{"url": ts.URL + "/eureka", "app": "FOO", "metadata.zone": "a"})
+	if err != nil || name != "eureka|"+ts.URL+"/eureka/FOO?metadata.zone=a&status=UP:/TCP" {
+		t.Fatalf("eurekaSourceLoader() = %q, %v", name, err)
+	}
+	if got, err := load(context.Background(), 0, nil); err != nil || len(got) != 1 || got[0].Addresses["10.0.0.1"].Hostname != "foo-1-example-com" {
+		t.Errorf("load() = %v, %v", got, err)
+	}
+	for _, invalid := range []fluconf.Config{{}, {"app": "FOO", "url": "eureka:8761"}, {"app": "FOO", "port": "http"}} {
+		if _, _, err := eurekaSourceLoader(invalid); err == nil {
+			t.Errorf("eurekaSourceLoader(%v) want error", invalid)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+type (
+	// fileEntry is an address of JSON or YAML files, port is a port list as port= of static sources
+	fileEntry struct {
+		IP        string                  `json:"ip"`
+		Port      filePort                `json:"port,omitempty"`
+		Hostname  string                  `json:"hostname,omitempty"`
+		NodeName  string                  `json:"nodeName,omitempty"`
+		TargetRef *corev1.ObjectReference `json:"targetRef,omitempty"`
+	}
+	// filePort is a port number or list
+	filePort string
+)
+
+func (p *filePort) UnmarshalJSON(data []byte) error {
+	var val interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&val); err != nil {
+		return err
+	}
+	switch val := val.(type) {
+	case json.Number:
+		*p = filePort(val.String())
+	case string:
+		*p = filePort(val)
+	case nil:
+		*p = ""
+	default:
+		return fmt.Errorf("illegal port %s", data)
+	}
+	return nil
+}
+
+// fileFormat is format=, or json or yaml by extension of the path, or lines
+func fileFormat(path, format string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "lines"
+}
+
+// parseFileEntries parses a JSON or YAML list of fileEntry, or lines of ip[:port], skipping blank lines and # comments
+func parseFileEntries(data []byte, format string) ([]fileEntry, error) {
+	entries := []fileEntry{}
+	switch format {
+	case "yaml":
+		var err error
+		if data, err = yaml.ToJSON(data); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case "json":
+		if len(bytes.TrimSpace(data)) == 0 || bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+			return entries, nil
+		}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+		return entries, nil
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if net.ParseIP(line) != nil {
+			entries = append(entries, fileEntry{IP: line})
+			continue
+		}
+		ip, port, err := net.SplitHostPort(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		entries = append(entries, fileEntry{IP: ip, Port: filePort(port)})
+	}
+	return entries, nil
+}
+
+// fileResults validates entries and loads them as static sources, with port of entries without ports;
+// ports of duplicated ips are joined
+func fileResults(entries []fileEntry, port, protocol string, overwrite bool) ([]LoadResult, error) {
+	ips, ipPorts, addresses := []string{}, map[string]string{}, map[string]corev1.EndpointAddress{}
+	for i, entry := range entries {
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("entries[%d]: illegal ip %q", i, entry.IP)
+		}
+		entryPort := string(entry.Port)
+		if entryPort != "" {
+			if _, err := parseProtocolPorts(entryPort, protocol); err != nil {
+				return nil, fmt.Errorf("entries[%d]: %v", i, err)
+			}
+		} else if entryPort = port; port == "" {
+			return nil, fmt.Errorf("entries[%d]: port required", i)
+		}
+		if _, ok := addresses[ip.String()]; ok {
+			// like records of other sources, see sourceEntries, keeping the address of the first entry
+			if ipPort, ok := ipPorts[ip.String()]; ok || entryPort != port {
+				if !ok {
+					ipPort = port
+				}
+				ipPorts[ip.String()] = ipPort + "," + entryPort
+			}
+			continue
+		}
+		ips = append(ips, ip.String())
+		if entry.Port != "" {
+			ipPorts[ip.String()] = entryPort
+		}
+		addr := corev1.EndpointAddress{IP: ip.String(), Hostname: hostnameLabel(entry.Hostname), TargetRef: entry.TargetRef}
+		if entry.NodeName != "" {
+			addr.NodeName = &entry.NodeName
+		}
+		addresses[ip.String()] = addr
+	}
+	results, err := portSetResults(ips, ipPorts, port, protocol)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Addresses, results[i].Overwrite = addresses, overwrite
+	}
+	return results, nil
+}
+
+// fileSourceLoader loads addresses of path=, see parseFileEntries and fileResults;
+// an empty file is an error unless allow-empty=yes, as it may be being written
+func fileSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
+	path, port, protocol, overwrite := conf.GetString("path", ""),
+		conf.GetString("port", ""),
+		strings.ToUpper(conf.GetString("protocol", "TCP")),
+		conf.GetBool("overwrite", false)
+	format, allowEmpty := fileFormat(path, strings.ToLower(conf.GetString("format", ""))), conf.GetBool("allow-empty", false)
+	switch {
+	case path == "":
+		return nil, "", fmt.Errorf("illegal file %v: path required", conf)
+	case format != "json" && format != "yaml" && format != "lines":
+		return nil, "", fmt.Errorf("illegal format %v", format)
+	}
+	if port != "" {
+		if _, err := parseProtocolPorts(port, protocol); err != nil {
+			return nil, "", err
+		}
+	}
+	return func(context.Context, time.Duration, *log.Logger) ([]LoadResult, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseFileEntries(data, format)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%s: %v", path, err)
+		case len(entries) == 0 && !allowEmpty:
+			return nil, fmt.Errorf("%s: no entries", path)
+		}
+		results, err := fileResults(entries, port, protocol, overwrite)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return results, nil
+	}, fmt.Sprintf("file|%s:%s/%s", path, port, protocol), nil
+}
+
+// fileSourceWatch notifies changes of the directory of path=, which follows replaces of the file,
+// eg. the ..data symlink of mounted ConfigMaps
+func fileSourceWatch(conf fluconf.Config) WatchFunc {
+	dir := filepath.Dir(conf.GetString("path", ""))
+	return func(ctx context.Context, logger *log.Logger) <-chan struct{} {
+		changes, err := watchDir(ctx, dir)
+		if err != nil {
+			logger.Printf("watch %s: %v", dir, err)
+		}
+		return changes
+	}
+}
@@ -0,0 +1,117 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_parseFileEntries(t *testing.T) {
+	want := []fileEntry{{IP: "10.0.0.1", Port: "80"}, {IP: "10.0.0.2", Port: "53/UDP,53/TCP", Hostname: "dns-1"}, {IP: "10.0.0.3"}}
+	for format, data := range map[string]string{
+		"json":  `[{"ip": "10.0.0.1", "port": 80}, {"ip": "10.0.0.2", "port": "53/UDP,53/TCP", "hostname": "dns-1"}, {"ip": "10.0.0.3"}]`,
+		"yaml":  "- ip: 10.0.0.1\n  port: 80\n- ip: 10.0.0.2\n  port: 53/UDP,53/TCP\n  hostname: dns-1\n- ip: 10.0.0.3\n",
+		"lines": "# inventory\n10.0.0.1:80\n\n10.0.0.2:53/UDP,53/TCP\n10.0.0.3\n",
+	} {
+		got, err := parseFileEntries([]byte(data), format)
+		want := append([]fileEntry{}, want...)
+		if format == "lines" {
+			want[1].Hostname = ""
+		}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseFileEntries(%s) = %v, %v, want %v", format, got, err, want)
+		}
+	}
+	if got, err := parseFileEntries([]byte("[::1]:80\n::2\n"), "lines"); err != nil || !reflect.DeepEqual(got, []fileEntry{{IP: "::1", Port: "80"}, {IP: "::2"}}) {
+		t.Errorf("parseFileEntries(ipv6) = %v, %v", got, err)
+	}
+	for format, data := range map[string]string{"json": `{"ip": "10.0.0.1"}`, "yaml": "ip: [", "lines": "10.0.0.1:80:81"} {
+		if _, err := parseFileEntries([]byte(data), format); err == nil {
+			t.Errorf("parseFileEntries(%s, %q) want error", format, data)
+		}
+	}
+}
+
+func Test_fileSourceLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	load, name, err := fileSourceLoader(fluconf.Config{"path": path, "port": "80", "overwrite": "yes"})
+	if err != nil || name != "file|"+path+":80/TCP" {
+		t.Fatalf("fileSourceLoader() = %q, %v", name, err)
+	}
+	for data, wantErr := range map[string]bool{
+		``:                                  true,
+		`[]`:                                true,
+		`[{"ip": "10.0.0.1"}, {"ip": "x"}]`: true,
+		`[{"ip": "10.0.0.1"}, {"ip": "10.0.0.1"}]`: false,
+		`[{"ip": "10.0.0.1", "port": "0"}]`:        true,
+		`[{"ip": "10.0.0.1", "port": 8080}]`:       false,
+	} {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := load(context.Background(), 0, nil); (err != nil) != wantErr {
+			t.Errorf("load(%q) error = %v, want error %v", data, err, wantErr)
+		}
+	}
+	ioutil.WriteFile(path, []byte(`[{"ip": "10.0.0.1", "nodeName": "node-1"}, {"ip": "10.0.0.2", "port": "53/UDP"}]`), 0644)
+	got, err := load(context.Background(), 0, nil)
+	node := "node-1"
+	addresses := map[string]corev1.EndpointAddress{"10.0.0.1": {IP: "10.0.0.1", NodeName: &node}, "10.0.0.2": {IP: "10.0.0.2"}}
+	want := []LoadResult{
+		{IPs: []string{"10.0.0.1"}, Addresses: addresses, Ports: []int{80}, PortNames: map[int]string{}, Protocol: "TCP", Overwrite: true},
+		{IPs: []string{"10.0.0.2"}, Addresses: addresses, Ports: []int{53}, PortNames: map[int]string{}, Protocol: "UDP", Overwrite: true},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("load() = %v, %v, want %v", got, err, want)
+	}
+
+	ioutil.WriteFile(path, []byte(`[{"ip": "10.0.0.1", "hostname": "a"}, {"ip": "10.0.0.1", "port": 8080, "hostname": "b"}, {"ip": "10.0.0.2", "port": 53}, {"ip": "10.0.0.2", "port": "53/UDP"}]`), 0644)
+	got, err = load(context.Background(), 0, nil)
+	addresses = map[string]corev1.EndpointAddress{"10.0.0.1": {IP: "10.0.0.1", Hostname: "a"}, "10.0.0.2": {IP: "10.0.0.2"}}
+	want = []LoadResult{
+		{IPs: []string{"10.0.0.1"}, Addresses: addresses, Ports: []int{80, 8080}, PortNames: map[int]string{}, Protocol: "TCP", Overwrite: true},
+		{IPs: []string{"10.0.0.2"}, Addresses: addresses, Ports: []int{53}, PortNames: map[int]string{}, Protocol: "TCP", Overwrite: true},
+		{IPs: []string{"10.0.0.2"}, Addresses: addresses, Ports: []int{53}, PortNames: map[int]string{}, Protocol: "UDP", Overwrite: true},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("load() of duplicated ips = %v, %v, want %v", got, err, want)
+	}
+
+	for _, invalid := range []fluconf.Config{{}, {"path": path, "format": "xml"}, {"path": path, "port": "http"}} {
+		if _, _, err := fileSourceLoader(invalid); err == nil {
+			t.Errorf("fileSourceLoader(%v) want error", invalid)
+		}
+	}
+}
+
+func Test_fileSourceWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := fileSourceWatch(fluconf.Config{"path": filepath.Join(dir, "inventory")})(ctx, nil)
+	if changes == nil {
+		t.Skip("watch not supported")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "inventory"), []byte("10.0.0.1:80\n"), 0644)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Errorf("change not notified")
+	}
+}
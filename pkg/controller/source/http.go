@@ -0,0 +1,216 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const maxHTTPSourceBody = 16 << 20
+
+// httpEntryFields are options of jsonpaths of fields of entries, relative to each entry
+var httpEntryFields = map[string]func(*fileEntry, string){
+	"ip-path":       func(entry *fileEntry, val string) { entry.IP = val },
+	"port-path":     func(entry *fileEntry, val string) { entry.Port = filePort(val) },
+	"hostname-path": func(entry *fileEntry, val string) { entry.Hostname = val },
+}
+
+// httpCache is the last response, reused if not modified
+type httpCache struct {
+	etag, lastModified string
+	results            []LoadResult
+}
+
+// decodeHTTPDocument decodes a JSON or YAML document, keeping numbers as json.Number
+func decodeHTTPDocument(data []byte) (interface{}, error) {
+	data, err := yaml.ToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func jsonPathString(val interface{}, steps []jsonPathStep) (string, bool) {
+	for _, item := range evalJSONPath(val, steps) {
+		switch item := item.(type) {
+		case string:
+			return item, true
+		case json.Number:
+			return item.String(), true
+		}
+	}
+	return "", false
+}
+
+// loadHTTPExtractor extracts entries of documents by template=, which renders lines of ip[:port],
+// or by jsonpath= (defaults to the document) selecting entries or lists of entries, see fileEntry;
+// entries may be ip[:port] strings, and ip-path=, port-path= and hostname-path= select fields of entries
+func loadHTTPExtractor(conf fluconf.Config) (func(interface{}) ([]fileEntry, error), error) {
+	if text, ok := conf["template"]; ok {
+		tmpl, err := template.New("entries").Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("illegal template: %v", err)
+		}
+		return func(doc interface{}) ([]fileEntry, error) {
+			out := &bytes.Buffer{}
+			if err := tmpl.Execute(out, doc); err != nil {
+				return nil, err
+			}
+			return parseFileEntries(out.Bytes(), "lines")
+		}, nil
+	}
+	steps, err := parseJSONPath(conf.GetString("jsonpath", ""))
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string][]jsonPathStep{}
+	for option := range httpEntryFields {
+		if path, ok := conf[option]; ok {
+			if fields[option], err = parseJSONPath(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return func(doc interface{}) ([]fileEntry, error) {
+		values, entries := []interface{}{}, []fileEntry{}
+		for _, val := range evalJSONPath(doc, steps) {
+			if items, ok := val.([]interface{}); ok {
+				values = append(values, items...)
+			} else {
+				values = append(values, val)
+			}
+		}
+		for i, val := range values {
+			entry := fileEntry{}
+			switch val := val.(type) {
+			case string:
+				lineEntries, err := parseFileEntries([]byte(val), "lines")
+				if err != nil || len(lineEntries) != 1 {
+					return nil, fmt.Errorf("entries[%d]: illegal entry %q", i, val)
+				}
+				entry = lineEntries[0]
+			case map[string]interface{}:
+				data, _ := json.Marshal(val)
+				if err := json.Unmarshal(data, &entry); err != nil {
+					return nil, fmt.Errorf("entries[%d]: %v", i, err)
+				}
+				for option, steps := range fields {
+					if field, ok := jsonPathString(val, steps); ok {
+						httpEntryFields[option](&entry, field)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("entries[%d]: illegal entry %v", i, val)
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}, nil
+}
+
+// httpSourceLoader polls url= for a JSON or YAML document of entries, see loadHTTPExtractor and fileResults,
+// with header= and TLS options of https probes; unmodified responses of If-None-Match or If-Modified-Since are not reprocessed
+func httpSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
+	rawURL, port, protocol, overwrite := conf.GetString("url", ""),
+		conf.GetString("port", ""),
+		strings.ToUpper(conf.GetString("protocol", "TCP")),
+		conf.GetBool("overwrite", false)
+	allowEmpty := conf.GetBool("allow-empty", false)
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("illegal url %q", rawURL)
+	}
+	if port != "" {
+		if _, err := parseProtocolPorts(port, protocol); err != nil {
+			return nil, "", err
+		}
+	}
+	header, err := prober.LoadHeader(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	tlsConfig, err := prober.LoadTLSConfig(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	extract, err := loadHTTPExtractor(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	client, cache := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}, &httpCache{}
+	// loads are sequential, see prober.StatusUpdater, so the cache is not locked
+	return func(ctx context.Context, timeout time.Duration, _ *log.Logger) ([]LoadResult, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header = header.Clone()
+		if req.Header.Get("Accept") == "" {
+			req.Header.Set("Accept", "application/json, application/yaml;q=0.9, */*;q=0.8")
+		}
+		if cache.results != nil {
+			if cache.etag != "" {
+				req.Header.Set("If-None-Match", cache.etag)
+			}
+			if cache.lastModified != "" {
+				req.Header.Set("If-Modified-Since", cache.lastModified)
+			}
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		switch {
+		case res.StatusCode == http.StatusNotModified && cache.results != nil:
+			return cache.results, nil
+		case res.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("%s: %s", rawURL, res.Status)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxHTTPSourceBody))
+		if err != nil {
+			return nil, err
+		}
+		doc, err := decodeHTTPDocument(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rawURL, err)
+		}
+		entries, err := extract(doc)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%s: %v", rawURL, err)
+		case len(entries) == 0 && !allowEmpty:
+			return nil, fmt.Errorf("%s: no entries", rawURL)
+		}
+		results, err := fileResults(entries, port, protocol, overwrite)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rawURL, err)
+		}
+		cache.etag, cache.lastModified, cache.results = res.Header.Get("ETag"), res.Header.Get("Last-Modified"), results
+		return results, nil
+	}, fmt.Sprintf("http|%s:%s/%s", rawURL, port, protocol), nil
+}
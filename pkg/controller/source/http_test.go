@@ -0,0 +1,67 @@
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+func Test_httpSourceLoader(t *testing.T) {
+	body, processed := `{"services": {"web": [{"address": "10.0.0.1", "servicePort": 8080}, "10.0.0.2:80"]}}`, int32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&processed, 1)
+		res.Header().Set("ETag", `"v1"`)
+		res.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	load, name, err := httpSourceLoader(fluconf.Config{"url": ts.URL, "port": "80", "jsonpath": "{.services.web}", "ip-path": "{.address}", "port-path": "{.servicePort}"})
+	if err != nil || name != "http|"+ts.URL+":80/TCP" {
+		t.Fatalf("httpSourceLoader() = %q, %v", name, err)
+	}
+	want := []LoadResult{
+		{IPs: []string{"10.0.0.1"}, Ports: []int{8080}, PortNames: map[int]string{}, Protocol: "TCP"},
+		{IPs: []string{"10.0.0.2"}, Ports: []int{80}, PortNames: map[int]string{}, Protocol: "TCP"},
+	}
+	for i := 0; i < 2; i++ {
+		got, err := load(context.Background(), 0, nil)
+		for j := range got {
+			got[j].Addresses = nil
+		}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("load() = %v, %v, want %v", got, err, want)
+		}
+	}
+	if got := atomic.LoadInt32(&processed); got != 1 {
+		t.Errorf("processed %v responses, want 1", got)
+	}
+
+	body = "hosts:\n- name: web-1\n  ip: 10.0.0.3\n"
+	load, _, err = httpSourceLoader(fluconf.Config{"url": ts.URL + "/yaml", "template": "{{range .hosts}}{{.ip}}:443\n{{end}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := load(context.Background(), 0, nil); err != nil || len(got) != 1 || !reflect.DeepEqual(got[0].IPs, []string{"10.0.0.3"}) || !reflect.DeepEqual(got[0].Ports, []int{443}) {
+		t.Errorf("load() of template = %v, %v", got, err)
+	}
+
+	for _, invalid := range []fluconf.Config{
+		{"url": "ftp://example.com"},
+		{"url": ts.URL, "jsonpath": "{.items[x]}"},
+		{"url": ts.URL, "template": "{{"},
+		{"url": ts.URL, "header": "invalid"},
+	} {
+		if _, _, err := httpSourceLoader(invalid); err == nil {
+			t.Errorf("httpSourceLoader(%v) want error", invalid)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package source
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is a field, an index, or all items if wildcard
+type jsonPathStep struct {
+	field    *string
+	index    *int
+	wildcard bool
+}
+
+func (s jsonPathStep) apply(val interface{}) []interface{} {
+	switch val := val.(type) {
+	case map[string]interface{}:
+		if s.field != nil {
+			if item, ok := val[*s.field]; ok {
+				return []interface{}{item}
+			}
+		} else if s.wildcard {
+			keys, items := make([]string, 0, len(val)), make([]interface{}, 0, len(val))
+			for key := range val {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				items = append(items, val[key])
+			}
+			return items
+		}
+	case []interface{}:
+		if s.wildcard {
+			return val
+		} else if s.index != nil {
+			if i := *s.index; i >= 0 && i < len(val) {
+				return []interface{}{val[i]}
+			} else if i < 0 && -i <= len(val) {
+				return []interface{}{val[len(val)+i]}
+			}
+		}
+	}
+	return nil
+}
+
+// parseJSONPath parses a subset of JSONPath as of kubectl, eg. {.items[*].address}: .field, ['field'], [n] and [*] or .*
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	expr := strings.TrimSpace(path)
+	if strings.HasPrefix(expr, "{") && strings.HasSuffix(expr, "}") {
+		expr = expr[1 : len(expr)-1]
+	}
+	steps := []jsonPathStep{}
+	for expr = strings.TrimPrefix(expr, "$"); expr != ""; {
+		switch {
+		case strings.HasPrefix(expr, ".*"):
+			steps, expr = append(steps, jsonPathStep{wildcard: true}), expr[2:]
+		case expr[0] == '.':
+			end := strings.IndexAny(expr[1:], ".[") + 1
+			if end == 0 {
+				end = len(expr)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("illegal jsonpath %v: empty field", path)
+			}
+			field := expr[1:end]
+			steps, expr = append(steps, jsonPathStep{field: &field}), expr[end:]
+		case expr[0] == '[':
+			end := strings.Index(expr, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("illegal jsonpath %v: unclosed [", path)
+			}
+			switch item := strings.TrimSpace(expr[1:end]); {
+			case item == "*":
+				steps = append(steps, jsonPathStep{wildcard: true})
+			case len(item) >= 2 && (item[0] == '\'' || item[0] == '"') && item[len(item)-1] == item[0]:
+				field := item[1 : len(item)-1]
+				steps = append(steps, jsonPathStep{field: &field})
+			default:
+				index, err := strconv.Atoi(item)
+				if err != nil {
+					return nil, fmt.Errorf("illegal jsonpath %v: illegal index %v", path, item)
+				}
+				steps = append(steps, jsonPathStep{index: &index})
+			}
+			expr = expr[end+1:]
+		default:
+			return nil, fmt.Errorf("illegal jsonpath %v", path)
+		}
+	}
+	return steps, nil
+}
+
+// evalJSONPath returns the values of steps of val
+func evalJSONPath(val interface{}, steps []jsonPathStep) []interface{} {
+	values := []interface{}{val}
+	for _, step := range steps {
+		next := []interface{}{}
+		for _, value := range values {
+			next = append(next, step.apply(value)...)
+		}
+		values = next
+	}
+	return values
+}
@@ -0,0 +1,44 @@
+package source
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseJSONPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"ip": "10.0.0.1", "tags": map[string]interface{}{"b": "2", "a": "1"}},
+			map[string]interface{}{"ip": "10.0.0.2"},
+		},
+		"a.b": "dotted",
+	}
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"", []interface{}{doc}},
+		{"{.items[*].ip}", []interface{}{"10.0.0.1", "10.0.0.2"}},
+		{"$.items[1].ip", []interface{}{"10.0.0.2"}},
+		{"{.items[-1].ip}", []interface{}{"10.0.0.2"}},
+		{".items[0].tags.*", []interface{}{"1", "2"}},
+		{"{['a.b']}", []interface{}{"dotted"}},
+		{"{.items[2].ip}", []interface{}{}},
+		{"{.missing.ip}", []interface{}{}},
+	}
+	for _, tt := range tests {
+		steps, err := parseJSONPath(tt.path)
+		if err != nil {
+			t.Errorf("parseJSONPath(%q) error: %v", tt.path, err)
+			continue
+		}
+		if got := evalJSONPath(doc, steps); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("evalJSONPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	for _, invalid := range []string{"{..ip}", "{.items[x]}", "{.items[0}", "items"} {
+		if _, err := parseJSONPath(invalid); err == nil {
+			t.Errorf("parseJSONPath(%q) want error", invalid)
+		}
+	}
+}
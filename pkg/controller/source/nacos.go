@@ -0,0 +1,196 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+)
+
+type (
+	// nacosInstances is the response of /v1/ns/instance/list
+	nacosInstances struct {
+		Checksum string          `json:"checksum"`
+		Hosts    []nacosInstance `json:"hosts"`
+	}
+	nacosInstance struct {
+		InstanceID string            `json:"instanceId"`
+		IP         string            `json:"ip"`
+		Port       int               `json:"port"`
+		Healthy    bool              `json:"healthy"`
+		Enabled    *bool             `json:"enabled"`
+		Metadata   map[string]string `json:"metadata"`
+	}
+	// nacosState is the access token, and the last instances reused while the checksum is not changed
+	nacosState struct {
+		token       string
+		tokenExpiry time.Time
+		checksum    string
+		results     []LoadResult
+	}
+)
+
+// nacosEntry is the address of an instance, with the port of metadata portMetadata if given
+func nacosEntry(instance nacosInstance, portMetadata string) (fileEntry, error) {
+	entry := fileEntry{IP: instance.IP, Port: filePort(strconv.Itoa(instance.Port))}
+	if portMetadata != "" {
+		val, ok := instance.Metadata[portMetadata]
+		if !ok {
+			return entry, fmt.Errorf("no metadata %s", portMetadata)
+		}
+		entry.Port = filePort(val)
+	}
+	return entry, nil
+}
+
+// nacosSourceLoader imports instances of service= of group= and namespace= from the Nacos server of url=
+// (defaults to http://127.0.0.1:8848/nacos), logged in by username= and password=, with header= and TLS options of https probes;
+// instances are filtered by cluster= (comma separated), healthy-only= (defaults to yes), enabled and metadata.<key>=,
+// with the port, or the port of metadata port-metadata= if given, eg. of a secure port.
+// Changes of the naming API are pushed over UDP or gRPC rather than long polls, so instances are polled,
+// and not reprocessed while the checksum is not changed
+func nacosSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
+	rawURL, service, port, protocol, overwrite := strings.TrimSuffix(conf.GetString("url", "http://127.0.0.1:8848/nacos"), "/"),
+		conf.GetString("service", ""),
+		conf.GetString("port", ""),
+		strings.ToUpper(conf.GetString("protocol", "TCP")),
+		conf.GetBool("overwrite", false)
+	username, password := conf.GetString("username", ""), conf.GetString("password", "")
+	healthyOnly, portMetadata, allowEmpty := conf.GetBool("healthy-only", true), conf.GetString("port-metadata", ""), conf.GetBool("allow-empty", false)
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("illegal url %q", rawURL)
+	}
+	if service == "" {
+		return nil, "", fmt.Errorf("illegal nacos %v: service required", conf)
+	}
+	if port != "" {
+		if _, err := parseProtocolPorts(port, protocol); err != nil {
+			return nil, "", err
+		}
+	}
+	query, name := url.Values{"serviceName": {service}, "healthyOnly": {strconv.FormatBool(healthyOnly)}}, url.Values{}
+	for option, param := range map[string]string{"group": "groupName", "namespace": "namespaceId", "cluster": "clusters"} {
+		if val, ok := conf[option]; ok {
+			query.Set(param, val)
+			name.Set(option, val)
+		}
+	}
+	if !healthyOnly {
+		name.Set("healthy-only", "no")
+	}
+	if portMetadata != "" {
+		name.Set("port-metadata", portMetadata)
+	}
+	selector := loadMetadataSelector(conf, name)
+	header, err := prober.LoadHeader(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	tlsConfig, err := prober.LoadTLSConfig(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	client, state := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}, &nacosState{}
+	// loads are sequential, see prober.StatusUpdater, so the state is not locked
+	return func(ctx context.Context, timeout time.Duration, logger *log.Logger) ([]LoadResult, error) {
+		params := url.Values{}
+		for key, vals := range query {
+			params[key] = vals
+		}
+		if username != "" {
+			if state.token == "" || time.Now().After(state.tokenExpiry) {
+				token, expiry, err := nacosLogin(ctx, client, rawURL, header, username, password)
+				if err != nil {
+					return nil, err
+				}
+				state.token, state.tokenExpiry = token, expiry
+			}
+			params.Set("accessToken", state.token)
+		}
+		instances := nacosInstances{}
+		if err := nacosGet(ctx, client, rawURL+"/v1/ns/instance/list?"+params.Encode(), header, &instances); err != nil {
+			// the token may be revoked, eg. on restarts of Nacos, so failed requests log in again
+			state.token = ""
+			return nil, err
+		}
+		if instances.Checksum != "" && instances.Checksum == state.checksum {
+			return state.results, nil
+		}
+		entries := newSourceEntries(port, protocol, logger)
+		for _, instance := range instances.Hosts {
+			if (healthyOnly && !instance.Healthy) || (instance.Enabled != nil && !*instance.Enabled) || !matchMetadata(selector, instance.Metadata) {
+				continue
+			}
+			entry, err := nacosEntry(instance, portMetadata)
+			entries.add(instance.InstanceID, []fileEntry{entry}, err)
+		}
+		if len(entries.entries) == 0 && !allowEmpty {
+			return nil, fmt.Errorf("nacos %s: no instances", service)
+		}
+		results, err := fileResults(entries.entries, port, protocol, overwrite)
+		if err != nil {
+			return nil, err
+		}
+		state.checksum, state.results = instances.Checksum, results
+		return results, nil
+	}, fmt.Sprintf("nacos|%s/%s?%s:%s/%s", rawURL, service, name.Encode(), port, protocol), nil
+}
+
+// nacosLogin gets an access token, expiring at 3/4 of its ttl
+func nacosLogin(ctx context.Context, client *http.Client, rawURL string, header http.Header, username, password string) (string, time.Time, error) {
+	req, err := http.NewRequest(http.MethodPost, rawURL+"/v1/auth/login", strings.NewReader(url.Values{"username": {username}, "password": {password}}.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	login := struct {
+		AccessToken string `json:"accessToken"`
+		TokenTTL    int64  `json:"tokenTtl"`
+	}{}
+	if err := nacosDo(client, req, &login); err != nil {
+		return "", time.Time{}, err
+	}
+	return login.AccessToken, time.Now().Add(time.Duration(login.TokenTTL) * time.Second * 3 / 4), nil
+}
+
+func nacosGet(ctx context.Context, client *http.Client, rawURL string, header http.Header, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header.Clone()
+	return nacosDo(client, req, out)
+}
+
+func nacosDo(client *http.Client, req *http.Request, out interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		// errors of urls would expose access tokens
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s: %v", req.URL.Path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s: %s %s", req.URL.Path, res.Status, strings.TrimSpace(string(message)))
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxHTTPSourceBody)).Decode(out); err != nil {
+		return fmt.Errorf("%s: %v", req.URL.Path, err)
+	}
+	return nil
+}
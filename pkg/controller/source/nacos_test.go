@@ -0,0 +1,88 @@
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+func Test_nacosSourceLoader(t *testing.T) {
+	lock, logins, lists := sync.Mutex{}, 0, []string{}
+	checksum := "c1"
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch req.URL.Path {
+		case "/nacos/v1/auth/login":
+			if req.PostFormValue("username") != "nacos" || req.PostFormValue("password") != "secret" {
+				res.WriteHeader(http.StatusForbidden)
+				return
+			}
+			logins++
+			res.Write([]byte(`{"accessToken": "token-1", "tokenTtl": 18000}`))
+		case "/nacos/v1/ns/instance/list":
+			if req.URL.Query().Get("accessToken") != "token-1" {
+				res.WriteHeader(http.StatusForbidden)
+				return
+			}
+			lists = append(lists, req.URL.Query().Encode())
+			res.Write([]byte(`{"name": "DEFAULT_GROUP@@foo", "checksum": "` + checksum + `", "hosts": [
+				{"instanceId": "10.0.0.1#8080", "ip": "10.0.0.1", "port": 8080, "healthy": true, "enabled": true, "metadata": {"version": "v1", "secure.port": "8443"}},
+				{"instanceId": "10.0.0.2#8080", "ip": "10.0.0.2", "port": 8080, "healthy": true, "enabled": false, "metadata": {"version": "v1"}},
+				{"instanceId": "10.0.0.3#8080", "ip": "10.0.0.3", "port": 8080, "healthy": false, "enabled": true, "metadata": {"version": "v1"}},
+				{"instanceId": "10.0.0.4#8080", "ip": "10.0.0.4", "port": 8080, "healthy": true, "enabled": true, "metadata": {"version": "v2"}}
+			]}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	conf := fluconf.Config{"url": ts.URL + "/nacos/", "service": "foo", "group": "DEFAULT_GROUP", "namespace": "dev",
+		"username": "nacos", "password": "secret", "metadata.version": "v1"}
+	load, name, err := nacosSourceLoader(conf)
+	if err != nil || name != "nacos|"+ts.URL+"/nacos/foo?group=DEFAULT_GROUP&metadata.version=v1&namespace=dev:/TCP" {
+		t.Fatalf("nacosSourceLoader() = %q, %v", name, err)
+	}
+	want := []LoadResult{{IPs: []string{"10.0.0.1"}, Ports: []int{8080}, PortNames: map[int]string{}, Protocol: "TCP"}}
+	for i := 0; i < 2; i++ {
+		got, err := load(context.Background(), 0, nil)
+		for i := range got {
+			got[i].Addresses = nil
+		}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("load() = %v, %v, want %v", got, err, want)
+		}
+	}
+	lock.Lock()
+	if logins != 1 || len(lists) != 2 || lists[0] != "accessToken=token-1&groupName=DEFAULT_GROUP&healthyOnly=true&namespaceId=dev&serviceName=foo" {
+		t.Errorf("logins = %v, lists = %v", logins, lists)
+	}
+	checksum = "c2"
+	lock.Unlock()
+
+	load, _, err = nacosSourceLoader(conf.CopyWithAll(fluconf.Config{"healthy-only": "no", "port-metadata": "secure.port", "metadata.version": "v1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := load(context.Background(), 0, nil); err != nil || len(got) != 1 || !reflect.DeepEqual(got[0].IPs, []string{"10.0.0.1"}) || !reflect.DeepEqual(got[0].Ports, []int{8443}) {
+		t.Errorf("load(port-metadata) = %v, %v", got, err)
+	}
+
+	load, _, err = nacosSourceLoader(conf.CopyWith("password", "wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(context.Background(), 0, nil); err == nil {
+		t.Errorf("load() of wrong password want error")
+	}
+	for _, invalid := range []fluconf.Config{{}, {"service": "foo", "url": "nacos:8848"}, {"service": "foo", "port": "http"}} {
+		if _, _, err := nacosSourceLoader(invalid); err == nil {
+			t.Errorf("nacosSourceLoader(%v) want error", invalid)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	corev1 "k8s.io/api/core/v1"
 )
 
 func intsInclude(ints []int, val int) []int {
@@ -20,6 +21,15 @@ func intsInclude(ints []int, val int) []int {
 	return append(ints, val)
 }
 
+func stringsIndex(strings []string, str string) int {
+	for i, s := range strings {
+		if s == str {
+			return i
+		}
+	}
+	return -1
+}
+
 func stringsInclude(strings []string, str string) []string {
 	for _, s := range strings {
 		if s == str {
@@ -31,10 +41,12 @@ func stringsInclude(strings []string, str string) []string {
 
 func nslookupSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
 	host, srv, port, protocol, overwrite, name := conf.GetString("host", ""), conf.GetString("srv", ""),
-		conf.GetInt("port", 0),
+		conf.GetString("port", ""),
 		strings.ToUpper(conf.GetString("protocol", "")),
 		conf.GetBool("overwrite", false), ""
-	var lookup func(context.Context, *log.Logger) ([]string, []int, error)
+	portName, portNames, hostnames := conf.GetString("port-name", ""), map[int]string(nil), conf.GetBool("hostname", true)
+	// lookup returns ips, ports and the host name of each ip
+	var lookup func(context.Context, *log.Logger) ([]string, []int, map[string]string, error)
 	if srv != "" {
 		parts := strings.SplitN(srv, ".", 3)
 		switch parts[1] {
@@ -47,60 +59,84 @@ func nslookupSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
 				return nil, "", fmt.Errorf("illegal srv %v", srv)
 			}
 		}
-		name, lookup = fmt.Sprintf("nslookup|SRV=%s", srv), func(ctx context.Context, logger *log.Logger) ([]string, []int, error) {
+		name, lookup = fmt.Sprintf("nslookup|SRV=%s", srv), func(ctx context.Context, logger *log.Logger) ([]string, []int, map[string]string, error) {
 			_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", srv)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
-			ips, ports := []string{}, []int{}
+			ips, ports, hosts := []string{}, []int{}, map[string]string{}
 			for _, addr := range addrs {
 				ports = intsInclude(ports, int(addr.Port))
 				if ip := net.ParseIP(addr.Target); ip != nil {
 					ips = stringsInclude(ips, ip.String())
 				} else if ipaddrs, err := net.DefaultResolver.LookupIPAddr(ctx, addr.Target); err == nil {
 					for _, ipaddr := range ipaddrs {
-						ips = stringsInclude(ips, ipaddr.IP.String())
+						ips, hosts[ipaddr.IP.String()] = stringsInclude(ips, ipaddr.IP.String()), addr.Target
 					}
 				} else {
 					logger.Printf("lookup host: %v", err)
 				}
 			}
 			if len(ips) > 0 {
-				return ips, ports, nil
+				return ips, ports, hosts, nil
 			}
-			return nil, nil, fmt.Errorf("lookup srv failed")
+			return nil, nil, nil, fmt.Errorf("lookup srv failed")
 		}
 	} else if host != "" {
-		if port <= 0 {
-			return nil, "", fmt.Errorf("illegal port %v", port)
+		ports, names, err := parsePorts(port)
+		if err != nil {
+			return nil, "", err
 		}
 		if protocol == "" {
 			protocol = "TCP"
 		}
-		name, lookup = fmt.Sprintf("nslookup|%s:%d/%s", host, port, protocol), func(ctx context.Context, logger *log.Logger) ([]string, []int, error) {
+		portNames = names
+		name, lookup = fmt.Sprintf("nslookup|%s:%s/%s", host, port, protocol), func(ctx context.Context, logger *log.Logger) ([]string, []int, map[string]string, error) {
 			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
-			ips := make([]string, len(addrs))
+			ips, hosts := make([]string, len(addrs)), map[string]string{}
 			for i, addr := range addrs {
 				ips[i] = addr.IP.String()
+				if net.ParseIP(host) == nil {
+					hosts[ips[i]] = host
+				}
 			}
-			return ips, []int{port}, nil
+			return ips, ports, hosts, nil
 		}
 	} else {
 		return nil, "", fmt.Errorf("illegal nslookup %v", conf)
 	}
-	return func(ctx context.Context, timeout time.Duration, logger *log.Logger) (*LoadResult, error) {
-		ips, ports, err := lookup(ctx, logger)
+	return func(ctx context.Context, timeout time.Duration, logger *log.Logger) ([]LoadResult, error) {
+		ips, ports, hosts, err := lookup(ctx, logger)
 		if err != nil {
 			return nil, err
 		}
-		return &LoadResult{
+		var addresses map[string]corev1.EndpointAddress
+		if hostnames {
+			addresses = map[string]corev1.EndpointAddress{}
+			for _, ip := range ips {
+				addresses[ip] = corev1.EndpointAddress{IP: ip, Hostname: hostnameLabel(hosts[ip])}
+			}
+		}
+		names := portNames
+		if srv != "" && portName != "" {
+			// port-name= names the port of the records, or each port as <port-name>-<port> if they have several
+			names = map[int]string{}
+			for _, port := range ports {
+				if names[port] = portName; len(ports) > 1 {
+					names[port] = fmt.Sprintf("%s-%d", portName, port)
+				}
+			}
+		}
+		return []LoadResult{{
 			IPs:       ips,
+			Addresses: addresses,
 			Ports:     ports,
+			PortNames: names,
 			Protocol:  protocol,
 			Overwrite: overwrite,
-		}, nil
+		}}, nil
 	}, name, nil
 }
@@ -4,26 +4,255 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
 	"github.com/xiaopal/kube-service-importer/pkg/prober"
+	corev1 "k8s.io/api/core/v1"
 )
 
 type (
-	// LoadFunc type
-	LoadFunc func(context.Context, time.Duration, *log.Logger) (*LoadResult, error)
+	// LoadFunc type, loads one result per port set and protocol
+	LoadFunc func(context.Context, time.Duration, *log.Logger) ([]LoadResult, error)
+	// WatchFunc type, notifies changes of a source until ctx is done, which are loaded besides the interval
+	WatchFunc func(ctx context.Context, logger *log.Logger) <-chan struct{}
 	// LoadResult type
 	LoadResult struct {
-		IPs       []string
-		Ports     []int
-		Protocol  string
-		Overwrite bool
+		IPs []string
+		// Addresses are Hostname, NodeName and TargetRef of IPs, nil leaves those of imported addresses as is
+		Addresses   map[string]corev1.EndpointAddress
+		Ports       []int
+		PortNames   map[int]string
+		Protocol    string
+		AppProtocol string
+		Overwrite   bool
+	}
+	// sourceRecord is a record of key-value stores, eg. keys of etcd or znodes of ZooKeeper
+	sourceRecord struct {
+		Key   string
+		Value []byte
 	}
 )
 
+var portNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,13}[a-z0-9])?$`)
+
+// parsePort parses a port with optional name, eg. http:80
+func parsePort(item string) (string, int, error) {
+	name, portVal := "", strings.TrimSpace(item)
+	if ss := strings.SplitN(portVal, ":", 2); len(ss) == 2 {
+		name, portVal = ss[0], ss[1]
+	}
+	port, err := strconv.Atoi(portVal)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("illegal port %v", item)
+	}
+	if name != "" && !portNamePattern.MatchString(name) {
+		return "", 0, fmt.Errorf("illegal port name %v", name)
+	}
+	return name, port, nil
+}
+
+// parsePorts parses ports with optional names, eg. port=http:80,https:443
+func parsePorts(val string) ([]int, map[int]string, error) {
+	ports, names := []int{}, map[int]string{}
+	for _, item := range strings.Split(val, ",") {
+		name, port, err := parsePort(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name != "" {
+			names[port] = name
+		}
+		ports = intsInclude(ports, port)
+	}
+	return ports, names, nil
+}
+
+// parseProtocolPorts parses ports with optional names and protocols, eg. port=dns:53/UDP,53/TCP,8080,
+// into results of each protocol in order of appearance, defaulting to protocol
+func parseProtocolPorts(val, protocol string) ([]LoadResult, error) {
+	results, protocols := []LoadResult{}, map[string]int{}
+	for _, item := range strings.Split(val, ",") {
+		portProtocol := protocol
+		if i := strings.LastIndex(item, "/"); i >= 0 {
+			item, portProtocol = item[:i], strings.ToUpper(strings.TrimSpace(item[i+1:]))
+		}
+		switch portProtocol {
+		case "TCP", "UDP", "SCTP":
+		default:
+			return nil, fmt.Errorf("illegal protocol %v", portProtocol)
+		}
+		name, port, err := parsePort(item)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := protocols[portProtocol]
+		if !ok {
+			i, protocols[portProtocol] = len(results), len(results)
+			results = append(results, LoadResult{Ports: []int{}, PortNames: map[int]string{}, Protocol: portProtocol})
+		}
+		if results[i].Ports = intsInclude(results[i].Ports, port); name != "" {
+			results[i].PortNames[port] = name
+		}
+	}
+	return results, nil
+}
+
+// portSetResults groups ips by their ports, ipPorts or port, into results of each port set and protocol
+func portSetResults(ips []string, ipPorts map[string]string, port, protocol string) ([]LoadResult, error) {
+	results, portSets := []LoadResult{}, map[string][]int{}
+	for _, ip := range ips {
+		ipPort, ok := ipPorts[ip]
+		if !ok {
+			ipPort = port
+		}
+		if _, ok := portSets[ipPort]; !ok {
+			portResults, err := parseProtocolPorts(ipPort, protocol)
+			if err != nil {
+				return nil, err
+			}
+			for _, result := range portResults {
+				portSets[ipPort], results = append(portSets[ipPort], len(results)), append(results, result)
+			}
+		}
+		for _, i := range portSets[ipPort] {
+			results[i].IPs = append(results[i].IPs, ip)
+		}
+	}
+	return results, nil
+}
+
+// hostnameLabel sanitizes a host name to a DNS label, eg. Host_1.example.com. to host-1-example-com
+func hostnameLabel(host string) string {
+	label := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		}
+		return '-'
+	}, strings.TrimSuffix(host, "."))
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return strings.Trim(label, "-")
+}
+
+// parseTargetRef parses kind/namespace/name, or kind/name
+func parseTargetRef(val string) (*corev1.ObjectReference, error) {
+	switch ss := strings.Split(val, "/"); {
+	case len(ss) == 2 && ss[0] != "" && ss[1] != "":
+		return &corev1.ObjectReference{Kind: ss[0], Name: ss[1]}, nil
+	case len(ss) == 3 && ss[0] != "" && ss[2] != "":
+		return &corev1.ObjectReference{Kind: ss[0], Namespace: ss[1], Name: ss[2]}, nil
+	}
+	return nil, fmt.Errorf("illegal target-ref %v", val)
+}
+
+// sourceEntries validates entries of records, skipping illegal records, and joins ports of duplicated ips
+type sourceEntries struct {
+	entries        []fileEntry
+	index          map[string]int
+	port, protocol string
+	logger         *log.Logger
+}
+
+func newSourceEntries(port, protocol string, logger *log.Logger) *sourceEntries {
+	return &sourceEntries{entries: []fileEntry{}, index: map[string]int{}, port: port, protocol: protocol, logger: logger}
+}
+
+// add adds entries of the record of key, or skips it on err or illegal entries
+func (s *sourceEntries) add(key string, entries []fileEntry, err error) {
+	for i := 0; err == nil && i < len(entries); i++ {
+		ip := net.ParseIP(entries[i].IP)
+		switch {
+		case ip == nil:
+			err = fmt.Errorf("illegal ip %q", entries[i].IP)
+		case entries[i].Port != "":
+			_, err = parseProtocolPorts(string(entries[i].Port), s.protocol)
+		case s.port == "":
+			err = fmt.Errorf("port required")
+		}
+		if ip != nil {
+			entries[i].IP = ip.String()
+		}
+	}
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Printf("skip %s: %v", key, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		i, ok := s.index[entry.IP]
+		if !ok {
+			s.index[entry.IP], s.entries = len(s.entries), append(s.entries, entry)
+			continue
+		}
+		if s.entries[i].Port != "" && entry.Port != "" {
+			s.entries[i].Port += "," + entry.Port
+		}
+	}
+}
+
+// recordEntries parses values of records, see sourceEntries
+func recordEntries(records []sourceRecord, parse func([]byte) ([]fileEntry, error), port, protocol string, logger *log.Logger) []fileEntry {
+	entries := newSourceEntries(port, protocol, logger)
+	for _, record := range records {
+		parsed, err := parse(record.Value)
+		entries.add(record.Key, parsed, err)
+	}
+	return entries.entries
+}
+
+// loadMetadataSelector loads metadata.<key>= options, which metadata of instances of registries must match,
+// added to query of source names
+func loadMetadataSelector(conf fluconf.Config, query url.Values) map[string]string {
+	selector := map[string]string{}
+	for key, val := range conf {
+		if strings.HasPrefix(key, "metadata.") {
+			selector[strings.TrimPrefix(key, "metadata.")] = val
+			query.Set(key, val)
+		}
+	}
+	return selector
+}
+
+func matchMetadata(selector, metadata map[string]string) bool {
+	for key, val := range selector {
+		if actual, ok := metadata[key]; !ok || actual != val {
+			return false
+		}
+	}
+	return true
+}
+
+// backoff waits before retrying after errors, up to a minute, until ctx is done
+func backoff(ctx context.Context, errors int) error {
+	if errors == 0 {
+		return nil
+	}
+	wait := time.Minute
+	if errors < 6 {
+		wait = time.Second << uint(errors)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
 // Loader func
-func Loader(conf fluconf.Config, updateFunc func(*LoadResult), logger *log.Logger) (prober.StatusProber, error) {
+func Loader(conf fluconf.Config, updateFunc func([]LoadResult), errorFunc func(error), logger *log.Logger) (prober.StatusProber, error) {
+	conf = SourceDefaults[conf["source"]].CopyWithAll(conf)
 	factory, ok := SourceFuncFactories[conf["source"]]
 	if !ok {
 		return nil, fmt.Errorf("illegal import config: %v", conf)
@@ -32,30 +261,77 @@ func Loader(conf fluconf.Config, updateFunc func(*LoadResult), logger *log.Logge
 	if err != nil {
 		return nil, err
 	}
+	appProtocol := conf.GetString("app-protocol", "")
 	loadSource, updateSource := func(ctx context.Context, timeout time.Duration) (interface{}, error) {
-		result, err := loader(ctx, timeout, logger)
+		results, err := loader(ctx, timeout, logger)
 		switch {
 		case err != nil:
+			if errorFunc != nil {
+				errorFunc(err)
+			}
 			return nil, err
-		case result == nil:
+		case results == nil:
 			return nil, prober.ErrorStatusUnknown
 		default:
-			return result, nil
+			for i := range results {
+				if results[i].AppProtocol == "" {
+					results[i].AppProtocol = appProtocol
+				}
+			}
+			// statuses are compared by the status updater, so a slice must be pointed to
+			return &results, nil
 		}
 	}, func(status interface{}) error {
 		if updateFunc != nil {
-			updateFunc(status.(*LoadResult))
+			updateFunc(*status.(*[]LoadResult))
 		}
 		return nil
 	}
 	source := prober.NewStatusProber(conf.GetString("name", name), loadSource, updateSource)
 	source.SetInterval(conf.GetDuration("interval", 30*time.Second))
 	source.SetTimeout(conf.GetDuration("timeout", 30*time.Second))
+	if watchFactory, ok := SourceWatchFactories[conf["source"]]; ok && conf.GetBool("watch", true) {
+		return &watchedSource{source, watchFactory(conf), logger}, nil
+	}
 	return source, nil
 }
 
+// watchedSource is a source loaded on changes, see prober.StatusWatcher
+type watchedSource struct {
+	prober.StatusProber
+	watch  WatchFunc
+	logger *log.Logger
+}
+
+func (s *watchedSource) Watch(ctx context.Context) <-chan struct{} {
+	return s.watch(ctx, s.logger)
+}
+
 // SourceFuncFactories var
 var SourceFuncFactories = map[string]func(conf fluconf.Config) (source LoadFunc, name string, err error){
-	"static":   staticSourceLoader,
-	"nslookup": nslookupSourceLoader,
+	"static":    staticSourceLoader,
+	"nslookup":  nslookupSourceLoader,
+	"file":      fileSourceLoader,
+	"http":      httpSourceLoader,
+	"consul":    consulSourceLoader,
+	"etcd":      etcdSourceLoader,
+	"zookeeper": zookeeperSourceLoader,
+	"eureka":    eurekaSourceLoader,
+	"nacos":     nacosSourceLoader,
+}
+
+// SourceDefaults var, options of source types, eg. short intervals between long polls;
+// interval and timeout default to 30s otherwise
+var SourceDefaults = map[string]fluconf.Config{
+	"consul":    {"interval": "1s", "timeout": "6m"},
+	"etcd":      {"interval": "5m"},
+	"zookeeper": {"interval": "5m"},
+	"nacos":     {"interval": "10s"},
+}
+
+// SourceWatchFactories var
+var SourceWatchFactories = map[string]func(conf fluconf.Config) WatchFunc{
+	"file":      fileSourceWatch,
+	"etcd":      etcdSourceWatch,
+	"zookeeper": zookeeperSourceWatch,
 }
@@ -0,0 +1,40 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+)
+
+func TestLoader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, updated := log.New(ioutil.Discard, "", 0), make(chan []LoadResult, 1)
+	source, err := Loader(fluconf.Config{"source": "static", "ip": "1.1.1.1", "port": "80,53/UDP", "app-protocol": "http"}, func(results []LoadResult) {
+		select {
+		case updated <- results:
+		default:
+		}
+	}, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := prober.NewStatusUpdater(ctx, logger)
+	updater.Start("test", source)
+	select {
+	case results := <-updated:
+		if len(results) != 2 || results[0].AppProtocol != "http" || results[1].Protocol != "UDP" {
+			t.Errorf("Loader() results = %v", results)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Loader() not updated")
+	}
+	if status, ok := updater.Status("test"); !ok || len(*status.(*[]LoadResult)) != 2 {
+		t.Errorf("Status() = %v, %v", status, ok)
+	}
+}
@@ -4,26 +4,83 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	corev1 "k8s.io/api/core/v1"
 )
 
+// staticIPOptions are options of an ip as <option>.<ip>=
+var staticIPOptions = []string{"port", "hostname", "node-name", "target-ref"}
+
+// staticSourceLoader loads ip= with port= (eg. port=53/UDP,53/TCP,8080), or port.<ip>= for the ip,
+// as one result per port set and protocol; hostname.<ip>=, node-name.<ip>= and target-ref.<ip>= set metadata of the ip
 func staticSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
 	ips, port, protocol, overwrite := strings.Split(conf.GetString("ip", ""), ","),
-		conf.GetInt("port", 0),
+		conf.GetString("port", ""),
 		strings.ToUpper(conf.GetString("protocol", "TCP")),
 		conf.GetBool("overwrite", false)
-	if port <= 0 {
-		return nil, "", fmt.Errorf("illegal port %v", port)
+	ipOptions, overrides, addresses := map[string]fluconf.Config{}, []string{}, map[string]corev1.EndpointAddress(nil)
+	for key, val := range conf {
+		for _, option := range staticIPOptions {
+			if !strings.HasPrefix(key, option+".") {
+				continue
+			}
+			ip := strings.TrimPrefix(key, option+".")
+			if stringsIndex(ips, ip) < 0 {
+				return nil, "", fmt.Errorf("illegal %s: ip not listed", key)
+			}
+			if ipOptions[ip] == nil {
+				ipOptions[ip] = fluconf.Config{}
+			}
+			ipOptions[ip][option] = val
+			if option == "port" {
+				overrides = append(overrides, fmt.Sprintf("%s:%s", ip, val))
+			} else {
+				overrides = append(overrides, fmt.Sprintf("%s=%s", key, val))
+			}
+		}
+	}
+	sort.Strings(overrides)
+	for ip, options := range ipOptions {
+		addr := corev1.EndpointAddress{IP: ip, Hostname: hostnameLabel(options["hostname"])}
+		if nodeName, ok := options["node-name"]; ok {
+			addr.NodeName = &nodeName
+		}
+		if targetRef, ok := options["target-ref"]; ok {
+			ref, err := parseTargetRef(targetRef)
+			if err != nil {
+				return nil, "", err
+			}
+			addr.TargetRef = ref
+		}
+		if addr.Hostname != "" || addr.NodeName != nil || addr.TargetRef != nil {
+			if addresses == nil {
+				addresses = map[string]corev1.EndpointAddress{}
+			}
+			addresses[ip] = addr
+		}
+	}
+	ipPorts := map[string]string{}
+	for ip, options := range ipOptions {
+		if ipPort, ok := options["port"]; ok {
+			ipPorts[ip] = ipPort
+		}
+	}
+	results, err := portSetResults(ips, ipPorts, port, protocol)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range results {
+		results[i].Addresses, results[i].Overwrite = addresses, overwrite
+	}
+	name := fmt.Sprintf("static|%s:%s/%s", strings.Join(ips, ","), port, protocol)
+	if len(overrides) > 0 {
+		name += "|" + strings.Join(overrides, ",")
 	}
-	return func(context.Context, time.Duration, *log.Logger) (*LoadResult, error) {
-		return &LoadResult{
-			IPs:       ips,
-			Ports:     []int{port},
-			Protocol:  protocol,
-			Overwrite: overwrite,
-		}, nil
-	}, fmt.Sprintf("static|%s:%d/%s", strings.Join(ips, ","), port, protocol), nil
+	return func(context.Context, time.Duration, *log.Logger) ([]LoadResult, error) {
+		return results, nil
+	}, name, nil
 }
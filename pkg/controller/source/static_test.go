@@ -0,0 +1,80 @@
+package source
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_staticSourceLoader(t *testing.T) {
+	node := "node-1"
+	tests := []struct {
+		conf     fluconf.Config
+		wantName string
+		want     []LoadResult
+	}{
+		{fluconf.Config{"ip": "1.1.1.1,2.2.2.2", "port": "80"}, "static|1.1.1.1,2.2.2.2:80/TCP", []LoadResult{
+			{IPs: []string{"1.1.1.1", "2.2.2.2"}, Ports: []int{80}, PortNames: map[int]string{}, Protocol: "TCP"},
+		}},
+		{fluconf.Config{"ip": "1.1.1.1", "port": "dns:53/UDP,53/tcp,8080", "overwrite": "yes"}, "static|1.1.1.1:dns:53/UDP,53/tcp,8080/TCP", []LoadResult{
+			{IPs: []string{"1.1.1.1"}, Ports: []int{53}, PortNames: map[int]string{53: "dns"}, Protocol: "UDP", Overwrite: true},
+			{IPs: []string{"1.1.1.1"}, Ports: []int{53, 8080}, PortNames: map[int]string{}, Protocol: "TCP", Overwrite: true},
+		}},
+		{fluconf.Config{"ip": "1.1.1.1,2.2.2.2,3.3.3.3", "port": "80", "protocol": "UDP", "port.2.2.2.2": "8080,53/TCP"}, "static|1.1.1.1,2.2.2.2,3.3.3.3:80/UDP|2.2.2.2:8080,53/TCP", []LoadResult{
+			{IPs: []string{"1.1.1.1", "3.3.3.3"}, Ports: []int{80}, PortNames: map[int]string{}, Protocol: "UDP"},
+			{IPs: []string{"2.2.2.2"}, Ports: []int{8080}, PortNames: map[int]string{}, Protocol: "UDP"},
+			{IPs: []string{"2.2.2.2"}, Ports: []int{53}, PortNames: map[int]string{}, Protocol: "TCP"},
+		}},
+		{fluconf.Config{"ip": "1.1.1.1", "port.1.1.1.1": "443"}, "static|1.1.1.1:/TCP|1.1.1.1:443", []LoadResult{
+			{IPs: []string{"1.1.1.1"}, Ports: []int{443}, PortNames: map[int]string{}, Protocol: "TCP"},
+		}},
+		{fluconf.Config{"ip": "1.1.1.1,2.2.2.2", "port": "80", "hostname.1.1.1.1": "Web_1", "node-name.1.1.1.1": "node-1", "target-ref.2.2.2.2": "Pod/default/web-2"},
+			"static|1.1.1.1,2.2.2.2:80/TCP|hostname.1.1.1.1=Web_1,node-name.1.1.1.1=node-1,target-ref.2.2.2.2=Pod/default/web-2", []LoadResult{
+				{IPs: []string{"1.1.1.1", "2.2.2.2"}, Addresses: map[string]corev1.EndpointAddress{
+					"1.1.1.1": {IP: "1.1.1.1", Hostname: "web-1", NodeName: &node},
+					"2.2.2.2": {IP: "2.2.2.2", TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-2"}},
+				}, Ports: []int{80}, PortNames: map[int]string{}, Protocol: "TCP"},
+			}},
+	}
+	for _, tt := range tests {
+		load, name, err := staticSourceLoader(tt.conf)
+		if err != nil {
+			t.Errorf("staticSourceLoader(%v) error: %v", tt.conf, err)
+			continue
+		}
+		got, _ := load(context.Background(), 0, nil)
+		if name != tt.wantName || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("staticSourceLoader(%v) = %q, %v, want %q, %v", tt.conf, name, got, tt.wantName, tt.want)
+		}
+	}
+
+	for _, invalid := range []fluconf.Config{
+		{"ip": "1.1.1.1"},
+		{"ip": "1.1.1.1", "port": "80/ICMP"},
+		{"ip": "1.1.1.1", "port": "Http:80"},
+		{"ip": "1.1.1.1", "port": "80", "port.2.2.2.2": "443"},
+		{"ip": "1.1.1.1", "port": "80", "target-ref.1.1.1.1": "web-1"},
+	} {
+		if _, _, err := staticSourceLoader(invalid); err == nil {
+			t.Errorf("staticSourceLoader(%v) want error", invalid)
+		}
+	}
+}
+
+func Test_hostnameLabel(t *testing.T) {
+	for host, want := range map[string]string{
+		"":                        "",
+		"xmpp-server.google.com.": "xmpp-server-google-com",
+		"Host_1.example.com":      "host-1-example-com",
+		"-a-":                     "a",
+		strings.Repeat("a", 70):   strings.Repeat("a", 63),
+	} {
+		if got := hostnameLabel(host); got != want {
+			t.Errorf("hostnameLabel(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
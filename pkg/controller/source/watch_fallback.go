@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package source
+
+import (
+	"context"
+)
+
+// watchDir is not supported, sources are loaded every interval only
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	return nil, nil
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package source
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchDir notifies changes of files in dir with inotify, until ctx is done
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO)
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// a non-blocking fd is polled by the runtime, so that closing it ends the read
+	file, changes := os.NewFile(uintptr(fd), "inotify"), make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
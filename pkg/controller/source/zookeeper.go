@@ -0,0 +1,560 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+// ops, xids, errors and states of the ZooKeeper protocol, see zookeeper.jute
+const (
+	zkOpGetData     = 4
+	zkOpGetChildren = 8
+	zkOpPing        = 11
+	zkOpClose       = -11
+
+	zkXidWatcher = -1
+	zkXidPing    = -2
+
+	zkErrNoNode = -101
+
+	zkStateExpired = -112
+
+	maxZKFrame = 16 << 20
+)
+
+var errZKSessionExpired = errors.New("zookeeper: session expired")
+
+// zkError is an error code of replies
+type zkError int32
+
+func (e zkError) Error() string {
+	if e == zkErrNoNode {
+		return "zookeeper: node does not exist"
+	}
+	return fmt.Sprintf("zookeeper: error %d", int32(e))
+}
+
+// zkWriter encodes jute records
+type zkWriter struct {
+	bytes.Buffer
+}
+
+func (w *zkWriter) putInt32(v int32) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *zkWriter) putInt64(v int64) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *zkWriter) putBytes(v []byte) {
+	w.putInt32(int32(len(v)))
+	w.Write(v)
+}
+
+func (w *zkWriter) putString(v string) {
+	w.putBytes([]byte(v))
+}
+
+func (w *zkWriter) putBool(v bool) {
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+// zkReader decodes jute records, err is the first error
+type zkReader struct {
+	data []byte
+	err  error
+}
+
+func (r *zkReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		if r.err == nil {
+			r.err = io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *zkReader) int32() int32 {
+	if v := r.next(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (r *zkReader) int64() int64 {
+	if v := r.next(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (r *zkReader) bytes() []byte {
+	if n := r.int32(); n > 0 {
+		return r.next(int(n))
+	}
+	return nil
+}
+
+func (r *zkReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *zkReader) bool() bool {
+	v := r.next(1)
+	return v != nil && v[0] != 0
+}
+
+// readZKFrame reads a length prefixed frame
+func readZKFrame(conn io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header)
+	if n > maxZKFrame {
+		return nil, fmt.Errorf("zookeeper: frame of %d bytes", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeZKFrame writes a length prefixed frame
+func writeZKFrame(conn io.Writer, frame []byte) error {
+	data := make([]byte, 4, 4+len(frame))
+	binary.BigEndian.PutUint32(data, uint32(len(frame)))
+	_, err := conn.Write(append(data, frame...))
+	return err
+}
+
+type (
+	// zkConn is a session of a ZooKeeper server, with watch events notified to changes;
+	// sessions are not resumed, so watchers reconnect with new sessions once done
+	zkConn struct {
+		conn    net.Conn
+		timeout time.Duration
+		lock    sync.Mutex
+		xid     int32
+		pending map[int32]chan zkReply
+		changes chan struct{}
+		done    chan struct{}
+		once    sync.Once
+		err     error
+	}
+	zkReply struct {
+		reader *zkReader
+		err    error
+	}
+)
+
+// dialZK connects a new session of the first available server
+func dialZK(ctx context.Context, servers []string, sessionTimeout time.Duration) (*zkConn, error) {
+	var lastErr error
+	for _, server := range servers {
+		c, err := connectZK(ctx, server, sessionTimeout)
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func connectZK(ctx context.Context, server string, sessionTimeout time.Duration) (*zkConn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > sessionTimeout {
+		deadline = time.Now().Add(sessionTimeout)
+	}
+	conn.SetDeadline(deadline)
+	req := &zkWriter{}
+	req.putInt32(0)
+	req.putInt64(0)
+	req.putInt32(int32(sessionTimeout / time.Millisecond))
+	req.putInt64(0)
+	req.putBytes(make([]byte, 16))
+	req.putBool(false)
+	if err := writeZKFrame(conn, req.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %v", server, err)
+	}
+	frame, err := readZKFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %v", server, err)
+	}
+	res := &zkReader{data: frame}
+	res.int32()
+	timeout := time.Duration(res.int32()) * time.Millisecond
+	if res.err != nil || timeout <= 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %v", server, errZKSessionExpired)
+	}
+	conn.SetDeadline(time.Time{})
+	c := &zkConn{conn: conn, timeout: timeout, pending: map[int32]chan zkReply{}, changes: make(chan struct{}, 1), done: make(chan struct{})}
+	go c.read()
+	go c.ping()
+	return c, nil
+}
+
+func (c *zkConn) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// Close closes the session
+func (c *zkConn) Close() {
+	c.lock.Lock()
+	req := &zkWriter{}
+	req.putInt32(c.xid + 1)
+	req.putInt32(zkOpClose)
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	writeZKFrame(c.conn, req.Bytes())
+	c.lock.Unlock()
+	c.close(errors.New("zookeeper: closed"))
+}
+
+// read dispatches replies and watch events, until the session is done or unresponsive
+func (c *zkConn) read() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		frame, err := readZKFrame(c.conn)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		res := &zkReader{data: frame}
+		xid, _, code := res.int32(), res.int64(), res.int32()
+		switch xid {
+		case zkXidPing:
+		case zkXidWatcher:
+			if res.int32(); res.int32() == zkStateExpired {
+				c.close(errZKSessionExpired)
+				return
+			}
+			select {
+			case c.changes <- struct{}{}:
+			default:
+			}
+		default:
+			c.lock.Lock()
+			reply, ok := c.pending[xid]
+			delete(c.pending, xid)
+			c.lock.Unlock()
+			if ok {
+				if code != 0 {
+					reply <- zkReply{err: zkError(code)}
+				} else {
+					reply <- zkReply{reader: res}
+				}
+			}
+		}
+	}
+}
+
+// ping keeps the session alive
+func (c *zkConn) ping() {
+	ticker := time.NewTicker(c.timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			req := &zkWriter{}
+			req.putInt32(zkXidPing)
+			req.putInt32(zkOpPing)
+			c.lock.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(c.timeout / 3))
+			err := writeZKFrame(c.conn, req.Bytes())
+			c.lock.Unlock()
+			if err != nil {
+				c.close(err)
+				return
+			}
+		}
+	}
+}
+
+// request sends requests of op in order of xids, and waits for the reply
+func (c *zkConn) request(ctx context.Context, op int32, path string, watch bool) (*zkReader, error) {
+	reply := make(chan zkReply, 1)
+	c.lock.Lock()
+	c.xid++
+	req := &zkWriter{}
+	req.putInt32(c.xid)
+	req.putInt32(op)
+	req.putString(path)
+	req.putBool(watch)
+	c.pending[c.xid] = reply
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	err := writeZKFrame(c.conn, req.Bytes())
+	c.lock.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+	select {
+	case res := <-reply:
+		return res.reader, res.err
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// children gets children of path, watched if watch
+func (c *zkConn) children(ctx context.Context, path string, watch bool) ([]string, error) {
+	res, err := c.request(ctx, zkOpGetChildren, path, watch)
+	if err != nil {
+		return nil, err
+	}
+	children := []string{}
+	for n := res.int32(); res.err == nil && len(children) < int(n); {
+		children = append(children, res.string())
+	}
+	return children, res.err
+}
+
+// data gets data of path, watched if watch
+func (c *zkConn) data(ctx context.Context, path string, watch bool) ([]byte, error) {
+	res, err := c.request(ctx, zkOpGetData, path, watch)
+	if err != nil {
+		return nil, err
+	}
+	data := res.bytes()
+	return data, res.err
+}
+
+// zkRecords gets data of children of path, watched if watch; children removed meanwhile are skipped
+func zkRecords(ctx context.Context, c *zkConn, path string, watch bool) ([]sourceRecord, error) {
+	children, err := c.children(ctx, path, watch)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+	records := make([]sourceRecord, 0, len(children))
+	for _, child := range children {
+		childPath := strings.TrimSuffix(path, "/") + "/" + child
+		data, err := c.data(ctx, childPath, watch)
+		switch {
+		case err == zkError(zkErrNoNode):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		records = append(records, sourceRecord{Key: childPath, Value: data})
+	}
+	return records, nil
+}
+
+type (
+	// zkInstance is a member of Finagle ServerSets, or a ServiceInstance of Curator service discovery
+	zkInstance struct {
+		ServiceEndpoint     *zkEndpoint           `json:"serviceEndpoint"`
+		AdditionalEndpoints map[string]zkEndpoint `json:"additionalEndpoints"`
+		Status              string                `json:"status"`
+		Shard               *int                  `json:"shard"`
+
+		Address string `json:"address"`
+		Port    *int   `json:"port"`
+		SSLPort *int   `json:"sslPort"`
+		Enabled *bool  `json:"enabled"`
+	}
+	zkEndpoint struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+)
+
+// zkInstanceParser parses ServerSet members of status ALIVE (or without status) and of shard if given,
+// with the serviceEndpoint or the additional endpoint of name endpoint; or Curator instances not disabled,
+// with port and sslPort if given
+func zkInstanceParser(endpoint string, shard *int) func([]byte) ([]fileEntry, error) {
+	return func(value []byte) ([]fileEntry, error) {
+		instance := zkInstance{}
+		if err := json.Unmarshal(value, &instance); err != nil {
+			return nil, err
+		}
+		switch {
+		case instance.ServiceEndpoint != nil || instance.AdditionalEndpoints != nil:
+			if (instance.Status != "" && instance.Status != "ALIVE") || (shard != nil && (instance.Shard == nil || *instance.Shard != *shard)) {
+				return []fileEntry{}, nil
+			}
+			serviceEndpoint := instance.ServiceEndpoint
+			if endpoint != "" {
+				additional, ok := instance.AdditionalEndpoints[endpoint]
+				if !ok {
+					return nil, fmt.Errorf("no endpoint %s", endpoint)
+				}
+				serviceEndpoint = &additional
+			}
+			if serviceEndpoint == nil {
+				return nil, fmt.Errorf("no serviceEndpoint")
+			}
+			return []fileEntry{{IP: serviceEndpoint.Host, Port: filePort(strconv.Itoa(serviceEndpoint.Port))}}, nil
+		case instance.Address != "":
+			if instance.Enabled != nil && !*instance.Enabled {
+				return []fileEntry{}, nil
+			}
+			ports := []string{}
+			for _, port := range []*int{instance.Port, instance.SSLPort} {
+				if port != nil {
+					ports = append(ports, strconv.Itoa(*port))
+				}
+			}
+			return []fileEntry{{IP: instance.Address, Port: filePort(strings.Join(ports, ","))}}, nil
+		}
+		return nil, fmt.Errorf("neither a ServerSet member nor a Curator instance")
+	}
+}
+
+// zkSourceConfig is servers= (comma separated, defaults to 127.0.0.1:2181), path= and session-timeout= (defaults to 30s)
+func zkSourceConfig(conf fluconf.Config) ([]string, string, time.Duration, error) {
+	servers, path, sessionTimeout := []string{}, conf.GetString("path", ""), conf.GetDuration("session-timeout", 30*time.Second)
+	for _, server := range strings.Split(conf.GetString("servers", "127.0.0.1:2181"), ",") {
+		server = strings.TrimSpace(server)
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, "", 0, fmt.Errorf("illegal server %q", server)
+		}
+		servers = append(servers, server)
+	}
+	switch {
+	case !strings.HasPrefix(path, "/"):
+		return nil, "", 0, fmt.Errorf("illegal zookeeper %v: path required", conf)
+	case sessionTimeout <= 0:
+		return nil, "", 0, fmt.Errorf("illegal session-timeout %v", sessionTimeout)
+	}
+	return servers, path, sessionTimeout, nil
+}
+
+// zookeeperSourceLoader imports children of path= of ZooKeeper, see zkSourceConfig, as ServerSet members or Curator instances,
+// see zkInstanceParser, of endpoint= and shard=; illegal children are skipped, and changes are watched, see zookeeperSourceWatch
+func zookeeperSourceLoader(conf fluconf.Config) (LoadFunc, string, error) {
+	port, protocol, overwrite := conf.GetString("port", ""),
+		strings.ToUpper(conf.GetString("protocol", "TCP")),
+		conf.GetBool("overwrite", false)
+	endpoint, allowEmpty := conf.GetString("endpoint", ""), conf.GetBool("allow-empty", false)
+	servers, path, sessionTimeout, err := zkSourceConfig(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	if port != "" {
+		if _, err := parseProtocolPorts(port, protocol); err != nil {
+			return nil, "", err
+		}
+	}
+	query, shard := url.Values{}, (*int)(nil)
+	if endpoint != "" {
+		query.Set("endpoint", endpoint)
+	}
+	if val, ok := conf["shard"]; ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, "", fmt.Errorf("illegal shard %q", val)
+		}
+		shard = &n
+		query.Set("shard", val)
+	}
+	parse := zkInstanceParser(endpoint, shard)
+	return func(ctx context.Context, timeout time.Duration, logger *log.Logger) ([]LoadResult, error) {
+		c, err := dialZK(ctx, servers, sessionTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		records, err := zkRecords(ctx, c, path, false)
+		if err != nil {
+			return nil, fmt.Errorf("zookeeper %s: %v", path, err)
+		}
+		entries := recordEntries(records, parse, port, protocol, logger)
+		if len(entries) == 0 && !allowEmpty {
+			return nil, fmt.Errorf("zookeeper %s: no instances", path)
+		}
+		return fileResults(entries, port, protocol, overwrite)
+	}, fmt.Sprintf("zookeeper|%s%s?%s:%s/%s", strings.Join(servers, ","), path, query.Encode(), port, protocol), nil
+}
+
+// zookeeperSourceWatch notifies changes of children of path= and their data, by watches of sessions,
+// which are reconnected with backoff once lost or expired
+func zookeeperSourceWatch(conf fluconf.Config) WatchFunc {
+	return func(ctx context.Context, logger *log.Logger) <-chan struct{} {
+		servers, path, sessionTimeout, err := zkSourceConfig(conf)
+		if err != nil {
+			logger.Printf("watch zookeeper: %v", err)
+			return nil
+		}
+		changes := make(chan struct{}, 1)
+		go func() {
+			for errors := 0; backoff(ctx, errors) == nil; {
+				connected, err := zkWatch(ctx, servers, path, sessionTimeout, changes)
+				if ctx.Err() != nil {
+					return
+				}
+				if errors++; connected {
+					errors = 1
+				}
+				logger.Printf("watch zookeeper %s: %v", path, err)
+			}
+		}()
+		return changes
+	}
+}
+
+// zkWatch watches path in a session, notifying changes once watches are set, until the session is done
+func zkWatch(ctx context.Context, servers []string, path string, sessionTimeout time.Duration, changes chan struct{}) (bool, error) {
+	c, err := dialZK(ctx, servers, sessionTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	for {
+		// watches are one-time triggers, so all are set again; changes meanwhile are loaded
+		if _, err := zkRecords(ctx, c, path, true); err != nil {
+			return true, err
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+		select {
+		case <-c.changes:
+		case <-c.done:
+			return true, c.err
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+}
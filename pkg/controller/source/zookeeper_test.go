@@ -0,0 +1,233 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+// fakeZK serves sessions of getChildren, getData and ping of nodes, notifying watches of sessions on changes
+type fakeZK struct {
+	sync.Mutex
+	listener net.Listener
+	nodes    map[string]string
+	sessions map[*fakeZKSession]bool
+}
+
+type fakeZKSession struct {
+	sync.Mutex
+	conn     net.Conn
+	watching bool
+}
+
+func (s *fakeZKSession) write(w *zkWriter) {
+	s.Lock()
+	defer s.Unlock()
+	writeZKFrame(s.conn, w.Bytes())
+}
+
+func newFakeZK(t *testing.T, nodes map[string]string) *fakeZK {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zk := &fakeZK{listener: listener, nodes: nodes, sessions: map[*fakeZKSession]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go zk.serve(conn)
+		}
+	}()
+	return zk
+}
+
+// event notifies watching sessions of state, or expires sessions
+func (zk *fakeZK) event(state int32) {
+	zk.Lock()
+	defer zk.Unlock()
+	for session := range zk.sessions {
+		if session.watching || state == zkStateExpired {
+			event := &zkWriter{}
+			event.putInt32(zkXidWatcher)
+			event.putInt64(0)
+			event.putInt32(0)
+			event.putInt32(4)
+			event.putInt32(state)
+			event.putString("/")
+			session.write(event)
+			session.watching = false
+		}
+		if state == zkStateExpired {
+			session.conn.Close()
+		}
+	}
+}
+
+func (zk *fakeZK) set(path, data string) {
+	zk.Lock()
+	zk.nodes[path] = data
+	zk.Unlock()
+	zk.event(3)
+}
+
+func (zk *fakeZK) serve(conn net.Conn) {
+	defer conn.Close()
+	if _, err := readZKFrame(conn); err != nil {
+		return
+	}
+	session := &fakeZKSession{conn: conn}
+	res := &zkWriter{}
+	res.putInt32(0)
+	res.putInt32(6000)
+	res.putInt64(1)
+	res.putBytes(make([]byte, 16))
+	session.write(res)
+	zk.Lock()
+	zk.sessions[session] = true
+	zk.Unlock()
+	defer func() {
+		zk.Lock()
+		delete(zk.sessions, session)
+		zk.Unlock()
+	}()
+	for {
+		frame, err := readZKFrame(conn)
+		if err != nil {
+			return
+		}
+		req := &zkReader{data: frame}
+		xid, op := req.int32(), req.int32()
+		res, body := &zkWriter{}, &zkWriter{}
+		code := int32(0)
+		switch op {
+		case zkOpPing, zkOpClose:
+		case zkOpGetChildren, zkOpGetData:
+			path, watch := req.string(), req.bool()
+			zk.Lock()
+			data, ok := zk.nodes[path]
+			children := []string{}
+			for node := range zk.nodes {
+				if strings.HasPrefix(node, path+"/") && !strings.Contains(node[len(path)+1:], "/") {
+					children = append(children, node[len(path)+1:])
+				}
+			}
+			if ok && watch {
+				session.watching = true
+			}
+			zk.Unlock()
+			switch {
+			case !ok:
+				code = zkErrNoNode
+			case op == zkOpGetChildren:
+				sort.Strings(children)
+				body.putInt32(int32(len(children)))
+				for _, child := range children {
+					body.putString(child)
+				}
+			default:
+				body.putString(data)
+				body.Write(make([]byte, 68))
+			}
+		}
+		res.putInt32(xid)
+		res.putInt64(0)
+		res.putInt32(code)
+		res.Write(body.Bytes())
+		session.write(res)
+		if op == zkOpClose {
+			return
+		}
+	}
+}
+
+func Test_zkInstanceParser(t *testing.T) {
+	shard := 1
+	for _, c := range []struct {
+		endpoint string
+		shard    *int
+		value    string
+		want     []fileEntry
+	}{
+		{"", nil, `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}, "additionalEndpoints": {"admin": {"host": "10.0.0.1", "port": 9990}}, "status": "ALIVE", "shard": 1}`,
+			[]fileEntry{{IP: "10.0.0.1", Port: "8080"}}},
+		{"admin", &shard, `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}, "additionalEndpoints": {"admin": {"host": "10.0.0.1", "port": 9990}}, "status": "ALIVE", "shard": 1}`,
+			[]fileEntry{{IP: "10.0.0.1", Port: "9990"}}},
+		{"", nil, `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}, "status": "STOPPING"}`, []fileEntry{}},
+		{"", &shard, `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}, "status": "ALIVE", "shard": 0}`, []fileEntry{}},
+		{"", nil, `{"name": "foo", "id": "1", "address": "10.0.0.2", "port": 8080, "sslPort": 8443, "serviceType": "DYNAMIC"}`,
+			[]fileEntry{{IP: "10.0.0.2", Port: "8080,8443"}}},
+		{"", nil, `{"name": "foo", "id": "1", "address": "10.0.0.2", "port": 8080, "sslPort": null, "enabled": false}`, []fileEntry{}},
+		{"admin", nil, `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}}`, nil},
+		{"", nil, `{"name": "foo"}`, nil},
+		{"", nil, `10.0.0.1:80`, nil},
+	} {
+		got, err := zkInstanceParser(c.endpoint, c.shard)([]byte(c.value))
+		if (err != nil) != (c.want == nil) || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("zkInstanceParser(%q)(%s) = %v, %v, want %v", c.endpoint, c.value, got, err, c.want)
+		}
+	}
+}
+
+func Test_zookeeperSourceLoader(t *testing.T) {
+	zk := newFakeZK(t, map[string]string{
+		"/services/foo":                    "",
+		"/services/foo/member_0000000001":  `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}, "status": "ALIVE"}`,
+		"/services/foo/member_0000000002":  `{"serviceEndpoint": {"host": "10.0.0.2", "port": 8080}, "status": "DEAD"}`,
+		"/services/foo/member_0000000003":  `{"serviceEndpoint": {"host": "host-3", "port": 8080}, "status": "ALIVE"}`,
+		"/services/foo/5b6e2d1c-curator-1": `{"name": "foo", "address": "10.0.0.1", "port": 8081}`,
+	})
+	defer zk.listener.Close()
+	conf := fluconf.Config{"servers": "127.0.0.1:1," + zk.listener.Addr().String(), "path": "/services/foo"}
+	load, name, err := zookeeperSourceLoader(conf)
+	if err != nil || name != "zookeeper|127.0.0.1:1,"+zk.listener.Addr().String()+"/services/foo?:/TCP" {
+		t.Fatalf("zookeeperSourceLoader() = %q, %v", name, err)
+	}
+	got, err := load(context.Background(), 0, nil)
+	if err != nil || len(got) != 1 || !reflect.DeepEqual(got[0].IPs, []string{"10.0.0.1"}) || !reflect.DeepEqual(got[0].Ports, []int{8081, 8080}) {
+		t.Errorf("load() = %v, %v", got, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := zookeeperSourceWatch(conf)(ctx, log.New(ioutil.Discard, "", 0))
+	for _, change := range []func(){
+		func() {},
+		func() {
+			zk.set("/services/foo/member_0000000004", `{"serviceEndpoint": {"host": "10.0.0.4", "port": 8080}}`)
+		},
+		func() { zk.event(zkStateExpired) },
+	} {
+		change()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch not notified")
+		}
+	}
+	if got, err := load(context.Background(), 0, nil); err != nil || len(got) != 2 {
+		t.Errorf("load() of changed = %v, %v", got, err)
+	}
+	for _, invalid := range []fluconf.Config{
+		{},
+		{"path": "services/foo"},
+		{"path": "/services/foo", "servers": "127.0.0.1"},
+		{"path": "/services/foo", "shard": "first"},
+		{"path": "/services/foo", "port": "http"},
+	} {
+		if _, _, err := zookeeperSourceLoader(invalid); err == nil {
+			t.Errorf("zookeeperSourceLoader(%v) want error", invalid)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type (
+	endpointsStatus struct {
+		Hosts   map[string]*hostStatusRecord  `json:"hosts,omitempty"`
+		Sources map[string]sourceStatusRecord `json:"sources,omitempty"`
+		Panic   bool                          `json:"panic,omitempty"`
+		Drains  map[string]drainStatusRecord  `json:"drains,omitempty"`
+	}
+	hostStatusRecord struct {
+		Ready  *bool                        `json:"ready,omitempty"`
+		Probes map[string]probeStatusRecord `json:"probes,omitempty"`
+	}
+	probeStatusRecord struct {
+		Result         string       `json:"result"`
+		Error          string       `json:"error,omitempty"`
+		Message        string       `json:"message,omitempty"`
+		Advisory       bool         `json:"advisory,omitempty"`
+		Successes      int          `json:"successes"`
+		Failures       int          `json:"failures"`
+		LastTransition *metav1.Time `json:"lastTransition,omitempty"`
+	}
+	drainStatusRecord struct {
+		Remove bool         `json:"remove,omitempty"`
+		Until  *metav1.Time `json:"until,omitempty"`
+	}
+	sourceStatusRecord struct {
+		LastRefresh   *metav1.Time `json:"lastRefresh,omitempty"`
+		Error         string       `json:"error,omitempty"`
+		LastErrorTime *metav1.Time `json:"lastErrorTime,omitempty"`
+	}
+)
+
+func probeResult(status interface{}, err error) string {
+	switch {
+	case err != nil:
+		return "Error"
+	case statusWeight(status) > 0:
+		return "Success"
+	case statusWeight(status) < 0:
+		return "Failure"
+	}
+	return "Unknown"
+}
+
+func statusWeight(status interface{}) int {
+	if weight, ok := status.(prober.StatusWeight); ok {
+		return weight.StatusWeight()
+	}
+	return 0
+}
+
+func metaTime(t time.Time) *metav1.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &metav1.Time{Time: t.Truncate(time.Second)}
+}
+
+func (h *targetRecord) buildStatus() *endpointsStatus {
+	status := &endpointsStatus{Hosts: map[string]*hostStatusRecord{}, Sources: map[string]sourceStatusRecord{}, Panic: h.panicMode}
+	hostStatus := func(host hostKey) *hostStatusRecord {
+		name := host.String()
+		record, ok := status.Hosts[name]
+		if !ok {
+			record = &hostStatusRecord{Probes: map[string]probeStatusRecord{}}
+			status.Hosts[name] = record
+		}
+		return record
+	}
+	for _, subset := range h.lastSubsets() {
+		for _, port := range subset.Ports {
+			for _, addr := range subset.Addresses {
+				hostStatus(hostKey{addr.IP, port.Port, string(port.Protocol)}).Ready = boolPtr(true)
+			}
+			for _, addr := range subset.NotReadyAddresses {
+				hostStatus(hostKey{addr.IP, port.Port, string(port.Protocol)}).Ready = boolPtr(false)
+			}
+		}
+	}
+	for key := range h.probes {
+		stats, ok := h.c.statusUpdater.Stats(key)
+		if !ok || stats.LastProbe.IsZero() {
+			continue
+		}
+		record := probeStatusRecord{
+			Result:         probeResult(stats.LastStatus, stats.LastError),
+			Message:        stats.LastMessage,
+			Advisory:       h.advisoryProbes[key],
+			Successes:      stats.Successes,
+			Failures:       stats.Failures,
+			LastTransition: metaTime(stats.LastTransition),
+		}
+		if stats.LastError != nil && stats.LastError != prober.ErrorStatusUnknown {
+			record.Error = stats.LastError.Error()
+		}
+		hostStatus(key.hostKey).Probes[key.probe] = record
+	}
+	for ip, d := range h.activeDrains(time.Now()) {
+		if status.Drains == nil {
+			status.Drains = map[string]drainStatusRecord{}
+		}
+		status.Drains[ip] = d.record()
+	}
+	for key := range h.sources {
+		state := h.sourceState(key)
+		record := sourceStatusRecord{LastRefresh: metaTime(state.lastRefresh), LastErrorTime: metaTime(state.lastErrorTime)}
+		if state.lastError != nil {
+			record.Error = state.lastError.Error()
+		}
+		status.Sources[key.source] = record
+	}
+	return status
+}
+
+// signature ignores counters, timestamps and messages, which change on every probe or load
+func (s *endpointsStatus) signature() string {
+	hosts, sources := map[string]*hostStatusRecord{}, map[string]sourceStatusRecord{}
+	for name, host := range s.Hosts {
+		probes := map[string]probeStatusRecord{}
+		for probe, record := range host.Probes {
+			record.Successes, record.Failures, record.Message = 0, 0, ""
+			probes[probe] = record
+		}
+		hosts[name] = &hostStatusRecord{Ready: host.Ready, Probes: probes}
+	}
+	for source, record := range s.Sources {
+		record.LastRefresh, record.LastErrorTime = nil, nil
+		sources[source] = record
+	}
+	data, _ := json.Marshal(&endpointsStatus{Hosts: hosts, Sources: sources, Panic: s.Panic, Drains: s.Drains})
+	return string(data)
+}
+
+// statusToPatch returns the status annotation to patch, or how long to wait before it may be patched again
+func (h *targetRecord) statusToPatch(now time.Time) (status string, signature string, wait time.Duration) {
+	if h.c.AnnotationStatus == "" || h.c.StatusInterval <= 0 {
+		return "", "", 0
+	}
+	record := h.buildStatus()
+	if signature = record.signature(); signature == h.statusSignature {
+		return "", "", 0
+	}
+	if wait = h.statusPatched.Add(h.c.StatusInterval).Sub(now); wait > 0 {
+		return "", "", wait
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", "", 0
+	}
+	return string(data), signature, 0
+}
+
+func (h *targetRecord) statusPatchedAt(signature string, now time.Time) {
+	if signature != "" {
+		h.statusSignature, h.statusPatched = signature, now
+	}
+}
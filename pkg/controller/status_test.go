@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_endpointsStatus_signature(t *testing.T) {
+	status := func(successes int, refresh time.Time, result string) *endpointsStatus {
+		return &endpointsStatus{
+			Hosts: map[string]*hostStatusRecord{
+				"1.1.1.1:80": {Ready: boolPtr(true), Probes: map[string]probeStatusRecord{
+					"tcp|1.1.1.1:80": {Result: result, Successes: successes},
+				}},
+			},
+			Sources: map[string]sourceStatusRecord{
+				"static|1.1.1.1:80/TCP": {LastRefresh: &metav1.Time{Time: refresh}},
+			},
+		}
+	}
+	now := time.Now()
+	if a, b := status(1, now, "Success").signature(), status(5, now.Add(time.Minute), "Success").signature(); a != b {
+		t.Errorf("signature() changed with counters: %v, %v", a, b)
+	}
+	if a, b := status(1, now, "Success").signature(), status(0, now, "Failure").signature(); a == b {
+		t.Errorf("signature() unchanged with result: %v", a)
+	}
+	if s := status(3, now, "Success"); s.signature() != "" && s.Hosts["1.1.1.1:80"].Probes["tcp|1.1.1.1:80"].Successes != 3 {
+		t.Errorf("signature() modified status")
+	}
+}
@@ -3,23 +3,130 @@ package controller
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	src "github.com/xiaopal/kube-service-importer/pkg/controller/source"
 	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
 	"github.com/xiaopal/kube-service-importer/pkg/prober"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ptypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// SourceLoadResult type
+type SourceLoadResult = src.LoadResult
+
 type objectKey struct {
 	namespace string
 	name      string
 }
 
 type hostKey struct {
-	ip   string
-	port int32
+	ip       string
+	port     int32
+	protocol string
+}
+
+func (k hostKey) String() string {
+	if k.protocol == "" || k.protocol == string(corev1.ProtocolTCP) {
+		return fmt.Sprintf("%s:%d", k.ip, k.port)
+	}
+	return fmt.Sprintf("%s:%d/%s", k.ip, k.port, k.protocol)
+}
+
+// matches returns whether the host serves one of ports
+func (k hostKey) matches(ports []corev1.EndpointPort) bool {
+	for _, port := range ports {
+		if k.port == port.Port && k.protocol == string(port.Protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// HealthScopePort evaluates probes of each port of an address separately
+	HealthScopePort = "port"
+	// HealthScopeHost evaluates all probes of an address together
+	HealthScopeHost = "host"
+)
+
+const (
+	// ProbeModeAll requires no probe of a port to fail
+	ProbeModeAll = "all"
+	// ProbeModeAny requires any probe of a port to pass
+	ProbeModeAny = "any"
+	// ProbeModeQuorum requires at least N probes of a port to pass, mode=quorum:N
+	ProbeModeQuorum = "quorum"
+)
+
+// probeMode combines results of the probes of a port, advisory probes excluded
+type probeMode struct {
+	mode   string
+	quorum int
+}
+
+func parseProbeMode(mode string) (probeMode, error) {
+	switch ss := strings.SplitN(mode, ":", 2); {
+	case mode == ProbeModeAll || mode == ProbeModeAny:
+		return probeMode{mode: mode}, nil
+	case ss[0] == ProbeModeQuorum && len(ss) == 2:
+		if quorum, err := strconv.Atoi(ss[1]); err == nil && quorum > 0 {
+			return probeMode{mode: ProbeModeQuorum, quorum: quorum}, nil
+		}
+	}
+	return probeMode{mode: ProbeModeAll}, fmt.Errorf("illegal mode %q", mode)
+}
+
+// probeCounts of the probes of a port, pending ones have no result yet
+type probeCounts struct {
+	total, passed, failed, neutral int
+}
+
+func (m probeMode) combine(counts probeCounts) (status bool, ok bool) {
+	switch m.mode {
+	case ProbeModeAny:
+		switch {
+		case counts.passed > 0:
+			return true, true
+		case counts.failed > 0:
+			return false, true
+		}
+	case ProbeModeQuorum:
+		pending := counts.total - counts.passed - counts.failed - counts.neutral
+		switch {
+		case counts.passed >= m.quorum:
+			return true, true
+		case counts.passed+pending < m.quorum && pending < counts.total:
+			return false, true
+		}
+	default:
+		switch {
+		case counts.failed > 0:
+			return false, true
+		case counts.passed > 0:
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// parseThreshold parses a count or percentage of addresses, eg. min-ready=2 or min-ready=50%
+func parseThreshold(name, val string) (*intstr.IntOrString, error) {
+	if val == "" {
+		return nil, nil
+	}
+	threshold := intstr.Parse(val)
+	if n, err := intstr.GetValueFromIntOrPercent(&threshold, 100, true); err != nil || n < 0 {
+		return nil, fmt.Errorf("illegal %s %q", name, val)
+	}
+	return &threshold, nil
 }
 
 type probeKey struct {
@@ -36,10 +143,44 @@ type sourceKey struct {
 type targetRecord struct {
 	c                       *endpointsImporter
 	key                     objectKey
+	uid                     ptypes.UID
+	skipMirror              bool
 	subsets                 atomic.Value
+	publishedSlices         string
 	probeConfs, sourceConfs []fluconf.Config
+	probeOpts               fluconf.Config
+	mode                    probeMode
+	minReady                *intstr.IntOrString
+	panicMode               bool
+	maxUnavailable          *intstr.IntOrString
+	removalInterval         time.Duration
+	lastRemoval             time.Time
+	removalWait             time.Duration
+	drains                  map[string]drain
+	service                 bool
 	probes                  map[probeKey]prober.StatusProber
+	advisoryProbes          map[probeKey]bool
 	sources                 map[sourceKey]prober.StatusProber
+	sourceStates            sync.Map
+	importName              string
+	publishedStatus         string
+	publishedStatusData     string
+	importStatusPatched     time.Time
+	statusSignature         string
+	statusPatched           time.Time
+}
+
+type sourceState struct {
+	lastRefresh   time.Time
+	lastError     error
+	lastErrorTime time.Time
+}
+
+func (h *targetRecord) sourceState(key sourceKey) sourceState {
+	if state, ok := h.sourceStates.Load(key); ok {
+		return state.(sourceState)
+	}
+	return sourceState{}
 }
 
 func (h *targetRecord) lastSubsets() []corev1.EndpointSubset {
@@ -55,19 +196,39 @@ func (h *targetRecord) updateSubsets(subsets []corev1.EndpointSubset) *targetRec
 	return h
 }
 
+// validateProbeConf checks the probe config with a placeholder host
+func validateProbeConf(conf fluconf.Config) error {
+	_, _, err := prober.LoadSimpleStatusProbeFunc(fluconf.Config{"ip": "127.0.0.1", "host": "127.0.0.1", "port": "1"}.CopyWithAll(conf))
+	return err
+}
+
 func (h *targetRecord) updateProbes(probeConfs []fluconf.Config) (bool, error) {
-	removedProbes, updatedProbes := h.probes, map[probeKey]prober.StatusProber{}
+	removedProbes, updatedProbes, validConfs := h.probes, map[probeKey]prober.StatusProber{}, []fluconf.Config{}
+	advisoryProbes := map[probeKey]bool{}
+	for _, conf := range probeConfs {
+		if err := validateProbeConf(conf); err != nil {
+			h.c.events.Event(h.key, h.uid, corev1.EventTypeWarning, EventInvalidProbeConfig, fmt.Sprintf("probe %s: %v", conf["probe"], err))
+			continue
+		}
+		validConfs = append(validConfs, conf)
+	}
 	for host := range hostItems(h.lastSubsets()) {
-		hostConf := fluconf.Config{"host": host.ip, "port": strconv.Itoa(int(host.port))}
-		for _, conf := range probeConfs {
-			probe := prober.LoadSimpleStatusProber(hostConf.CopyWithAll(conf), func(_ int) error {
+		hostConf := fluconf.Config{"ip": host.ip, "host": host.ip, "port": strconv.Itoa(int(host.port)), "protocol": host.protocol}
+		for _, conf := range validConfs {
+			if protocol, ok := conf["protocol"]; ok && !strings.EqualFold(protocol, host.protocol) {
+				continue
+			}
+			probe := h.loadProbe(hostConf.CopyWithAll(conf), func(_ int) error {
 				h.c.notifyUpdate(h.key)
 				return nil
 			})
 			if name := probe.Name(); name != "" {
-				key := probeKey{h.key, host.hostKey, probe.Name()}
+				key := probeKey{h.key, host, probe.Name()}
 				updatedProbes[key] = probe
 				delete(removedProbes, key)
+				if conf.GetBool("advisory", false) {
+					advisoryProbes[key] = true
+				}
 				if loaded, _ := h.c.statusUpdater.Start(key, probe); !loaded {
 					h.c.logger.Printf("[healthcheck] %s/%s: start %v", key.namespace, key.name, probe)
 				}
@@ -76,22 +237,31 @@ func (h *targetRecord) updateProbes(probeConfs []fluconf.Config) (bool, error) {
 	}
 	for key, probe := range removedProbes {
 		h.c.statusUpdater.Stop(key)
+		h.c.metrics.forgetProbe(key)
 		h.c.logger.Printf("[healthcheck] %s/%s: stop %v", key.namespace, key.name, probe)
 	}
-	h.probeConfs, h.probes = probeConfs, updatedProbes
+	h.probeConfs, h.probes, h.advisoryProbes = probeConfs, updatedProbes, advisoryProbes
 	return len(probeConfs) > 0, nil
 }
 
 func (h *targetRecord) updateSources(sourceConfs []fluconf.Config, ready bool) (bool, error) {
 	removedSources, updatedSources := h.sources, map[sourceKey]prober.StatusProber{}
 	for _, sourceConf := range sourceConfs {
-		source, err := src.Loader(sourceConf, func(_ *src.LoadResult) {
+		var key sourceKey
+		source, err := src.Loader(sourceConf, func(_ []src.LoadResult) {
+			h.sourceStates.Store(key, sourceState{lastRefresh: time.Now()})
+			h.c.notifyUpdate(h.key)
+		}, func(err error) {
+			h.c.events.Event(h.key, h.uid, corev1.EventTypeWarning, EventSourceLookupFailed, fmt.Sprintf("source %s: %v", key.source, err))
+			state := h.sourceState(key)
+			state.lastError, state.lastErrorTime = err, time.Now()
+			h.sourceStates.Store(key, state)
 			h.c.notifyUpdate(h.key)
 		}, h.c.logger)
 		if err != nil {
 			return false, err
 		}
-		key := sourceKey{h.key, source.Name()}
+		key = sourceKey{h.key, source.Name()}
 		delete(removedSources, key)
 		updatedSources[key] = source
 		if loaded, _ := h.c.statusUpdater.Start(key, source); !loaded {
@@ -100,119 +270,309 @@ func (h *targetRecord) updateSources(sourceConfs []fluconf.Config, ready bool) (
 	}
 	for key, source := range removedSources {
 		h.c.statusUpdater.Stop(key)
+		h.c.metrics.forgetSource(key)
+		h.sourceStates.Delete(key)
 		h.c.logger.Printf("[sources] %s/%s: stop %v", key.namespace, key.name, source)
 	}
 	h.sourceConfs, h.sources = sourceConfs, updatedSources
 	return len(sourceConfs) > 0, nil
 }
 
-func (c *endpointsImporter) updateTarget(endpoints *corev1.Endpoints, probeConfs []fluconf.Config, sourceConfs []fluconf.Config) error {
+func (c *endpointsImporter) updateTarget(endpoints *corev1.Endpoints, probeOpts fluconf.Config, probeConfs []fluconf.Config, sourceConfs []fluconf.Config, drains map[string]drain) error {
 	targets, targetKey := c.targets, objectKey{namespace: endpoints.GetNamespace(), name: endpoints.GetName()}
 	target, targetOk := targets[targetKey]
-	if !targetOk && len(probeConfs) == 0 && len(sourceConfs) == 0 {
+	if !targetOk && len(probeConfs) == 0 && len(sourceConfs) == 0 && len(drains) == 0 {
 		return nil
 	}
 	if !targetOk {
 		target = &targetRecord{c: c, key: targetKey}
 		targets[targetKey] = target
 	}
-	target.updateSubsets(endpoints.Subsets)
+	target.uid, target.skipMirror = endpoints.GetUID(), endpoints.GetLabels()[LabelSkipMirror] == "true"
+	target.importName, target.probeOpts = importOwner(endpoints.GetOwnerReferences()), probeOpts
+	target.service = fluconf.Config{"service": endpoints.Annotations[c.AnnotationService]}.GetBool("service", false)
+	mode, err := parseProbeMode(probeOpts.GetString("mode", ProbeModeAll))
+	if err != nil {
+		c.events.Event(targetKey, target.uid, corev1.EventTypeWarning, EventInvalidProbeConfig, fmt.Sprintf("probes: %v", err))
+	}
+	minReady, err := parseThreshold("min-ready", probeOpts["min-ready"])
+	if err != nil {
+		c.events.Event(targetKey, target.uid, corev1.EventTypeWarning, EventInvalidProbeConfig, fmt.Sprintf("probes: %v", err))
+	}
+	maxUnavailable, err := parseThreshold("max-unavailable", probeOpts["max-unavailable"])
+	if err != nil {
+		c.events.Event(targetKey, target.uid, corev1.EventTypeWarning, EventInvalidProbeConfig, fmt.Sprintf("probes: %v", err))
+	}
+	target.mode, target.minReady, target.maxUnavailable = mode, minReady, maxUnavailable
+	target.removalInterval, target.drains = probeOpts.GetDuration("removal-interval", 0), drains
+	for _, d := range drains {
+		if wait := time.Until(d.until); wait > 0 {
+			c.updateQueue.AddAfter(targetKey, wait)
+		}
+	}
+	switch {
+	case c.Output.Endpoints():
+		target.updateSubsets(endpoints.Subsets)
+	case !targetOk:
+		subsets, err := c.loadEndpointSlices(targetKey)
+		if err != nil {
+			c.logger.Printf("%s/%s: load endpointslices: %v", targetKey.namespace, targetKey.name, err)
+		}
+		if err != nil || len(subsets) == 0 {
+			// no endpointslices are published yet, eg. of Endpoints imported before endpointslices were the only output
+			subsets = endpoints.Subsets
+		}
+		target.updateSubsets(subsets)
+	}
 	probes, errProbes := target.updateProbes(probeConfs)
 	sources, errSources := target.updateSources(sourceConfs, !probes)
 	if errSources != nil || errProbes != nil {
 		return fmt.Errorf("update: sources=%v, probes=%v", errSources, errProbes)
 	}
-	if !probes && !sources {
+	if !probes && !sources && len(drains) == 0 {
 		delete(targets, targetKey)
 	}
 	c.notifyUpdate(targetKey)
 	return nil
 }
 
-func (h *targetRecord) hostStatus(ip string) (status bool, ok bool) {
-	status, statusOK := false, false
+// hostStatus combines probes of each port of the address serving ports by mode, then requires no port to fail;
+// with health-scope=host all probes of the address are combined as one port
+func (h *targetRecord) hostStatus(ip string, ports []corev1.EndpointPort) (status bool, ok bool) {
+	perHost, portCounts := h.probeOpts.GetString("health-scope", HealthScopePort) == HealthScopeHost, map[hostKey]*probeCounts{}
 	for key := range h.probes {
-		if key.ip == ip {
-			probe, probeOK := h.c.statusUpdater.Status(key)
-			switch {
-			case !probeOK:
-				continue
-			case probe.(prober.StatusWeight).StatusWeight() < 0:
-				return false, true
-			case probe.(prober.StatusWeight).StatusWeight() > 0:
-				status, statusOK = true, true
+		if key.ip != ip || h.advisoryProbes[key] || !(perHost || key.matches(ports)) {
+			continue
+		}
+		port := key.hostKey
+		if perHost {
+			port = hostKey{ip: ip}
+		}
+		counts, ok := portCounts[port]
+		if !ok {
+			counts = &probeCounts{}
+			portCounts[port] = counts
+		}
+		counts.total++
+		if probe, probeOK := h.c.statusUpdater.Status(key); probeOK {
+			switch weight := statusWeight(probe); {
+			case weight > 0:
+				counts.passed++
+			case weight < 0:
+				counts.failed++
+			default:
+				counts.neutral++
 			}
 		}
 	}
-	return status, statusOK
+	for _, counts := range portCounts {
+		switch portStatus, portOK := h.mode.combine(*counts); {
+		case portOK && !portStatus:
+			return false, true
+		case portOK:
+			status, ok = true, true
+		}
+	}
+	return status, ok
+}
+
+func (h *targetRecord) owner() *metav1.OwnerReference {
+	if h.uid == "" {
+		return nil
+	}
+	return &metav1.OwnerReference{APIVersion: "v1", Kind: "Endpoints", Name: h.key.name, UID: h.uid}
+}
+
+func (h *targetRecord) buildPatch(subsets []corev1.EndpointSubset, update bool, status string) ([]byte, bool, error) {
+	patch, metadata := map[string]interface{}{}, map[string]interface{}{}
+	if update && h.c.Output.Endpoints() {
+		patchSubsets, err := withAppProtocols(subsets, h.appProtocols())
+		if err != nil {
+			return nil, false, err
+		}
+		patch["subsets"] = patchSubsets
+	}
+	if h.c.Output.EndpointSlices() && !h.skipMirror {
+		metadata["labels"] = map[string]string{LabelSkipMirror: "true"}
+	}
+	if status != "" {
+		metadata["annotations"] = map[string]string{h.c.AnnotationStatus: status}
+	}
+	if len(metadata) > 0 {
+		patch["metadata"] = metadata
+	}
+	if len(patch) > 0 {
+		data, err := json.Marshal(patch)
+		return data, err == nil, err
+	}
+	return nil, false, nil
 }
 
-func (h *targetRecord) buildPatch() ([]byte, bool, error) {
-	updateSubsets := []corev1.EndpointSubset{}
-	subsets, update := h.subsetsToPatch()
+// panics returns whether removing unhealthy addresses would leave fewer ready addresses in the subset than min-ready
+func (h *targetRecord) panics(subset corev1.EndpointSubset, drains map[string]drain) bool {
+	if h.minReady == nil {
+		return false
+	}
+	ready, removed := 0, 0
+	for _, addr := range subset.NotReadyAddresses {
+		if status, statusOK := h.hostStatus(addr.IP, subset.Ports); statusOK && status && !drained(drains, addr.IP) {
+			ready++
+		}
+	}
+	for _, addr := range subset.Addresses {
+		if drained(drains, addr.IP) {
+			continue
+		}
+		if status, statusOK := h.hostStatus(addr.IP, subset.Ports); statusOK && !status {
+			removed++
+			continue
+		}
+		ready++
+	}
+	minReady, _ := intstr.GetValueFromIntOrPercent(h.minReady, len(subset.Addresses)+len(subset.NotReadyAddresses), true)
+	return removed > 0 && ready < minReady
+}
+
+func (h *targetRecord) setPanicMode(panicMode bool) {
+	switch {
+	case panicMode && !h.panicMode:
+		h.c.events.Event(h.key, h.uid, corev1.EventTypeWarning, EventPanicModeEntered,
+			fmt.Sprintf("fewer than min-ready %s addresses would be ready, keeping the last ready addresses", h.minReady))
+	case !panicMode && h.panicMode:
+		h.c.events.Event(h.key, h.uid, corev1.EventTypeNormal, EventPanicModeExited, "enough addresses are ready, panic mode exited")
+	}
+	h.panicMode = panicMode
+}
+
+// removalBudget returns how many more addresses of the subset max-unavailable allows to be not ready, or -1 if unlimited
+func (h *targetRecord) removalBudget(subset corev1.EndpointSubset, notReady int) int {
+	if h.maxUnavailable == nil {
+		return -1
+	}
+	maxUnavailable, _ := intstr.GetValueFromIntOrPercent(h.maxUnavailable, len(subset.Addresses)+len(subset.NotReadyAddresses), false)
+	if budget := maxUnavailable - notReady; budget > 0 {
+		return budget
+	}
+	return 0
+}
+
+func drained(drains map[string]drain, ip string) bool {
+	_, ok := drains[ip]
+	return ok
+}
+
+// buildSubsets applies health to the subsets, promoting healthy addresses at once and marking unhealthy ones
+// not ready within max-unavailable and at most one per removal-interval; removalWait is when to retry deferred removals.
+// Drained addresses are not ready, or removed, regardless of health
+func (h *targetRecord) buildSubsets() ([]corev1.EndpointSubset, bool) {
+	updateSubsets, panicMode, now := []corev1.EndpointSubset{}, false, time.Now()
+	removalWait, drains := h.lastRemoval.Add(h.removalInterval).Sub(now), h.activeDrains(now)
+	subsets, update := h.subsetsToPatch(drains)
+	h.removalWait = 0
 	for _, subset := range subsets {
-		updateSubset := corev1.EndpointSubset{Ports: subset.Ports}
+		updateSubset, subsetPanics := corev1.EndpointSubset{Ports: subset.Ports}, h.panics(subset, drains)
+		panicMode = panicMode || subsetPanics
 		for _, addr := range subset.NotReadyAddresses {
 			addrs := &updateSubset.NotReadyAddresses
-			if status, statusOK := h.hostStatus(addr.IP); statusOK && status {
+			if d, ok := drains[addr.IP]; ok {
+				if d.remove {
+					update = true
+					continue
+				}
+			} else if status, statusOK := h.hostStatus(addr.IP, subset.Ports); statusOK && status {
 				addrs = &updateSubset.Addresses
 				update = true
 			}
 			*addrs = append(*addrs, addr)
 		}
+		budget := h.removalBudget(subset, len(updateSubset.NotReadyAddresses))
 		for _, addr := range subset.Addresses {
 			addrs := &updateSubset.Addresses
-			if status, statusOK := h.hostStatus(addr.IP); statusOK && !status {
-				addrs = &updateSubset.NotReadyAddresses
+			if d, ok := drains[addr.IP]; ok {
 				update = true
+				if d.remove {
+					continue
+				}
+				addrs = &updateSubset.NotReadyAddresses
+			} else if status, statusOK := h.hostStatus(addr.IP, subset.Ports); statusOK && !status && !subsetPanics {
+				switch {
+				case removalWait > 0:
+					h.removalWait = removalWait
+				case budget == 0:
+				default:
+					addrs, update, budget = &updateSubset.NotReadyAddresses, true, budget-1
+					if h.removalInterval > 0 {
+						h.lastRemoval, removalWait = now, h.removalInterval
+					}
+				}
 			}
 			*addrs = append(*addrs, addr)
 		}
 		updateSubsets = append(updateSubsets, updateSubset)
 	}
-	if update {
-		patch, err := json.Marshal(map[string]interface{}{"subsets": updateSubsets})
-		return patch, err == nil, err
+	h.setPanicMode(panicMode)
+	if h.service && nameServicePorts(updateSubsets) {
+		update = true
 	}
-	return nil, false, nil
+	return updateSubsets, update
 }
 
-func (h *targetRecord) sourceResults() ([]src.LoadResult, bool) {
-	results, overwrite := []src.LoadResult{}, false
+// sourceResults excludes addresses drained with remove=yes, and names unnamed ports of a multi-port Service
+func (h *targetRecord) sourceResults(drains map[string]drain) ([]src.LoadResult, bool) {
+	results, overwrite, ports := []src.LoadResult{}, false, map[string]bool{}
 	for key := range h.sources {
-		if source, sourceOK := h.c.statusUpdater.Status(key); sourceOK {
-			result := source.(*src.LoadResult)
+		source, sourceOK := h.c.statusUpdater.Status(key)
+		if !sourceOK {
+			continue
+		}
+		for _, result := range *source.(*[]src.LoadResult) {
 			if result.Overwrite {
 				overwrite = true
 			}
-			results = append(results, *result)
+			ips := make([]string, 0, len(result.IPs))
+			for _, ip := range result.IPs {
+				if d, ok := drains[ip]; !ok || !d.remove {
+					ips = append(ips, ip)
+				}
+			}
+			result.IPs = ips
+			results = append(results, result)
+			for _, port := range result.Ports {
+				ports[fmt.Sprintf("%d/%s", port, result.Protocol)] = true
+			}
+		}
+	}
+	if h.service && len(ports) > 1 {
+		for i, result := range results {
+			names := map[int]string{}
+			for _, port := range result.Ports {
+				if names[port] = result.PortNames[port]; names[port] == "" {
+					names[port] = servicePortName(corev1.EndpointPort{Port: int32(port), Protocol: corev1.Protocol(result.Protocol)})
+				}
+			}
+			results[i].PortNames = names
 		}
 	}
 	return results, overwrite
 }
 
-func (h *targetRecord) subsetsToPatch() ([]corev1.EndpointSubset, bool) {
-	sources, overwrite := h.sourceResults()
+func (h *targetRecord) subsetsToPatch(drains map[string]drain) ([]corev1.EndpointSubset, bool) {
+	sources, overwrite := h.sourceResults(drains)
 	return buildSubsets(h.lastSubsets(), sources, overwrite, len(h.probeConfs) > 0)
 }
 
-type hostItem struct {
-	hostKey
-	protocol string
-}
-
-func hostItems(subsets []corev1.EndpointSubset) map[hostItem]struct{} {
-	hosts, ok := map[hostItem]struct{}{}, struct{}{}
+func hostItems(subsets []corev1.EndpointSubset) map[hostKey]struct{} {
+	hosts, ok := map[hostKey]struct{}{}, struct{}{}
 	for _, subset := range subsets {
 		for _, port := range subset.Ports {
 			for _, addr := range subset.NotReadyAddresses {
 				if addr.IP != "" && port.Port > 0 {
-					hosts[hostItem{hostKey{addr.IP, port.Port}, string(port.Protocol)}] = ok
+					hosts[hostKey{addr.IP, port.Port, string(port.Protocol)}] = ok
 				}
 			}
 			for _, addr := range subset.Addresses {
 				if addr.IP != "" && port.Port > 0 {
-					hosts[hostItem{hostKey{addr.IP, port.Port}, string(port.Protocol)}] = ok
+					hosts[hostKey{addr.IP, port.Port, string(port.Protocol)}] = ok
 				}
 			}
 		}
@@ -220,30 +580,90 @@ func hostItems(subsets []corev1.EndpointSubset) map[hostItem]struct{} {
 	return hosts
 }
 
-func subsetMatches(subset corev1.EndpointSubset, source src.LoadResult) bool {
-	if len(source.Ports) != len(subset.Ports) {
+func subsetMatches(subset corev1.EndpointSubset, ports []corev1.EndpointPort) bool {
+	if len(ports) != len(subset.Ports) {
 		return false
 	}
-	sourcePorts := map[int]string{}
-	for _, port := range source.Ports {
-		sourcePorts[port] = source.Protocol
-	}
 	for _, port := range subset.Ports {
-		if protocol, ok := sourcePorts[int(port.Port)]; !ok || (protocol != string(port.Protocol)) {
+		if !endpointPortsContain(ports, port) {
 			return false
 		}
 	}
 	return true
 }
 
-func toEndpointPorts(ports []int, protocol string) []corev1.EndpointPort {
+func endpointPortsContain(ports []corev1.EndpointPort, port corev1.EndpointPort) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func toEndpointPorts(ports []int, names map[int]string, protocol string) []corev1.EndpointPort {
 	ret := make([]corev1.EndpointPort, len(ports))
 	for i, port := range ports {
-		ret[i] = corev1.EndpointPort{Port: int32(port), Protocol: corev1.Protocol(protocol)}
+		ret[i] = corev1.EndpointPort{Name: names[port], Port: int32(port), Protocol: corev1.Protocol(protocol)}
 	}
 	return ret
 }
 
+func appProtocolKey(name string, port int32, protocol corev1.Protocol) string {
+	return fmt.Sprintf("%s:%d/%s", name, port, protocol)
+}
+
+// appProtocols of ports of the sources by appProtocolKey
+func (h *targetRecord) appProtocols() map[string]string {
+	sources, _ := h.sourceResults(nil)
+	appProtocols := map[string]string{}
+	for _, source := range sources {
+		for _, port := range source.Ports {
+			if source.AppProtocol != "" {
+				appProtocols[appProtocolKey(source.PortNames[port], int32(port), corev1.Protocol(source.Protocol))] = source.AppProtocol
+			}
+		}
+	}
+	return appProtocols
+}
+
+// withAppProtocols converts val to JSON values, setting appProtocol, which the vendored API types lack, on its ports
+func withAppProtocols(val interface{}, appProtocols map[string]string) (interface{}, error) {
+	if len(appProtocols) == 0 {
+		return val, nil
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	var ret interface{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	var walk func(interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]interface{}:
+			if port, ok := v["port"].(float64); ok {
+				name, _ := v["name"].(string)
+				protocol, _ := v["protocol"].(string)
+				if appProtocol, ok := appProtocols[appProtocolKey(name, int32(port), corev1.Protocol(protocol))]; ok {
+					v["appProtocol"] = appProtocol
+				}
+			}
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(ret)
+	return ret, nil
+}
+
 func stringsContains(strings []string, str string) bool {
 	for _, s := range strings {
 		if s == str {
@@ -275,73 +695,131 @@ func excludeAddresses(subset corev1.EndpointSubset, excludeIPs []string) (corev1
 	return corev1.EndpointSubset{Ports: subset.Ports, Addresses: addresses, NotReadyAddresses: notReadyAddresses}, true
 }
 
-func includeAddresses(subset corev1.EndpointSubset, includeIPs []string, notReady bool) (corev1.EndpointSubset, bool) {
-	addresses, updated := &subset.Addresses, false
+// includeAddresses adds addresses of includeIPs, and updates metadata of included addresses unless addresses is nil
+func includeAddresses(subset corev1.EndpointSubset, includeIPs []string, addresses map[string]corev1.EndpointAddress, notReady bool) (corev1.EndpointSubset, bool) {
+	includes, updated := &subset.Addresses, false
 	if notReady {
-		addresses = &subset.NotReadyAddresses
+		includes = &subset.NotReadyAddresses
+	}
+	address := func(ip string) corev1.EndpointAddress {
+		addr := addresses[ip]
+		addr.IP = ip
+		return addr
+	}
+	included := func(addrs *[]corev1.EndpointAddress, ip string) bool {
+		for i, addr := range *addrs {
+			if addr.IP != ip {
+				continue
+			}
+			if want := address(ip); addresses != nil && !reflect.DeepEqual(addr, want) {
+				// addrs may be shared with the last subsets
+				*addrs = append([]corev1.EndpointAddress{}, *addrs...)
+				(*addrs)[i], updated = want, true
+			}
+			return true
+		}
+		return false
 	}
-include:
 	for _, ip := range includeIPs {
-		for _, addr := range subset.Addresses {
-			if addr.IP == ip {
-				continue include
+		if !included(&subset.Addresses, ip) && !included(&subset.NotReadyAddresses, ip) {
+			*includes = append(*includes, address(ip))
+			updated = true
+		}
+	}
+	return subset, updated
+}
+
+// sourceSubset is the ips of sources with the same ports, see groupSources
+type sourceSubset struct {
+	ips       []string
+	addresses map[string]corev1.EndpointAddress
+	ports     []corev1.EndpointPort
+}
+
+// groupSources groups ips of the sources by all of their ports, so that an ip of more than one result, eg. of ports
+// of more than one protocol, is kept in a single subset of all its ports rather than excluded by the other results
+func groupSources(sources []src.LoadResult) []sourceSubset {
+	ips, ipPorts, ipAddresses := []string{}, map[string][]corev1.EndpointPort{}, map[string]corev1.EndpointAddress{}
+	for _, source := range sources {
+		sourcePorts := toEndpointPorts(source.Ports, source.PortNames, source.Protocol)
+		for _, ip := range source.IPs {
+			ports, ok := ipPorts[ip]
+			if !ok {
+				ips = append(ips, ip)
+			}
+			for _, port := range sourcePorts {
+				if !endpointPortsContain(ports, port) {
+					ports = append(ports, port)
+				}
+			}
+			ipPorts[ip] = ports
+			if _, ok := ipAddresses[ip]; !ok && source.Addresses != nil {
+				ipAddresses[ip] = source.Addresses[ip]
 			}
 		}
-		for _, addr := range subset.NotReadyAddresses {
-			if addr.IP == ip {
-				continue include
+	}
+	groups := []sourceSubset{}
+	for _, ip := range ips {
+		var group *sourceSubset
+		for i := range groups {
+			if subsetMatches(corev1.EndpointSubset{Ports: groups[i].ports}, ipPorts[ip]) {
+				group = &groups[i]
+				break
+			}
+		}
+		if group == nil {
+			groups = append(groups, sourceSubset{ports: ipPorts[ip]})
+			group = &groups[len(groups)-1]
+		}
+		group.ips = append(group.ips, ip)
+		if addr, ok := ipAddresses[ip]; ok {
+			if group.addresses == nil {
+				group.addresses = map[string]corev1.EndpointAddress{}
 			}
+			group.addresses[ip] = addr
 		}
-		*addresses = append(*addresses, corev1.EndpointAddress{IP: ip})
-		updated = true
 	}
-	return subset, updated
+	return groups
 }
 
 func buildSubsets(subsets []corev1.EndpointSubset, sources []src.LoadResult, overwrite, notReady bool) ([]corev1.EndpointSubset, bool) {
 	if len(sources) == 0 {
 		return subsets, false
 	}
-	newSubsets, sourceMappings, update := make([]corev1.EndpointSubset, 0, len(sources)),
-		map[*src.LoadResult]*corev1.EndpointSubset{}, false
+	groups := groupSources(sources)
+	newSubsets, sourceMappings, update := make([]corev1.EndpointSubset, 0, len(groups)), make([]*corev1.EndpointSubset, len(groups)), false
 source:
-	for isource, source := range sources {
+	for igroup, group := range groups {
 		for isubset, subset := range subsets {
-			if subsetMatches(subset, source) {
-				sourceMappings[&sources[isource]] = &subsets[isubset]
+			if subsetMatches(subset, group.ports) {
+				sourceMappings[igroup] = &subsets[isubset]
 				continue source
 			}
 		}
-		for isubset, subset := range newSubsets {
-			if subsetMatches(subset, source) {
-				sourceMappings[&sources[isource]] = &newSubsets[isubset]
-				continue source
-			}
-		}
-		newSubsets = append(newSubsets, corev1.EndpointSubset{Ports: toEndpointPorts(source.Ports, source.Protocol)})
-		sourceMappings[&sources[isource]], update = &newSubsets[len(newSubsets)-1], true
+		newSubsets = append(newSubsets, corev1.EndpointSubset{Ports: group.ports})
+		sourceMappings[igroup], update = &newSubsets[len(newSubsets)-1], true
 	}
 
 	sourceIPs, ok, excluded, included := map[string]struct{}{}, struct{}{}, false, false
-	for isource, source := range sources {
-		sourceSubset := sourceMappings[&sources[isource]]
+	for igroup, group := range groups {
+		sourceSubset := sourceMappings[igroup]
 		for isubset := range subsets {
 			subset := &subsets[isubset]
 			if subset != sourceSubset {
-				*subset, excluded = excludeAddresses(*subset, source.IPs)
+				*subset, excluded = excludeAddresses(*subset, group.ips)
 				update = update || excluded
 			}
 		}
 		for isubset := range newSubsets {
 			subset := &newSubsets[isubset]
 			if subset != sourceSubset {
-				*subset, excluded = excludeAddresses(*subset, source.IPs)
+				*subset, excluded = excludeAddresses(*subset, group.ips)
 				update = update || excluded
 			}
 		}
-		*sourceSubset, included = includeAddresses(*sourceSubset, source.IPs, notReady)
+		*sourceSubset, included = includeAddresses(*sourceSubset, group.ips, group.addresses, notReady)
 		update = update || included
-		for _, ip := range source.IPs {
+		for _, ip := range group.ips {
 			sourceIPs[ip] = ok
 		}
 	}
@@ -1,10 +1,14 @@
 package controller
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/xiaopal/kube-service-importer/pkg/prober"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 func Test_buildSubsets(t *testing.T) {
@@ -97,10 +101,45 @@ func Test_buildSubsets(t *testing.T) {
 			{Addresses: []corev1.EndpointAddress{{IP: "4.4.4.4"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
 			{NotReadyAddresses: []corev1.EndpointAddress{{IP: "5.5.5.5"}}, Ports: []corev1.EndpointPort{{Port: 443, Protocol: corev1.ProtocolTCP}}},
 		}, true},
+		{"case-named-port", []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}, []SourceLoadResult{
+			{IPs: []string{"1.1.1.1"}, Ports: []int{80}, PortNames: map[int]string{80: "http"}, Protocol: "TCP"},
+		}, false, false, []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}}, Ports: []corev1.EndpointPort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}, true},
+		{"case-address-metadata", []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1", Hostname: "old"}, {IP: "2.2.2.2"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}, []SourceLoadResult{
+			{IPs: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}, Addresses: map[string]corev1.EndpointAddress{
+				"1.1.1.1": {Hostname: "one"}, "3.3.3.3": {Hostname: "three", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "three"}},
+			}, Ports: []int{80}, Protocol: "TCP"},
+		}, false, false, []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1", Hostname: "one"}, {IP: "2.2.2.2"}, {IP: "3.3.3.3", Hostname: "three", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "three"}}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}, true},
+		{"case-mixed-protocols", nil, []SourceLoadResult{
+			{IPs: []string{"1.1.1.1", "2.2.2.2"}, Ports: []int{53}, Protocol: "UDP"},
+			{IPs: []string{"1.1.1.1", "2.2.2.2"}, Ports: []int{53, 8080}, Protocol: "TCP"},
+		}, true, false, []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}, {IP: "2.2.2.2"}}, Ports: []corev1.EndpointPort{{Port: 53, Protocol: corev1.ProtocolUDP}, {Port: 53, Protocol: corev1.ProtocolTCP}, {Port: 8080, Protocol: corev1.ProtocolTCP}}},
+		}, true},
+		{"case-ip-of-sources", []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}, {IP: "2.2.2.2"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}, []SourceLoadResult{
+			{IPs: []string{"1.1.1.1", "2.2.2.2"}, Ports: []int{80}, Protocol: "TCP"},
+			{IPs: []string{"2.2.2.2"}, Ports: []int{53}, Protocol: "UDP"},
+		}, true, false, []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "1.1.1.1"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+			{Addresses: []corev1.EndpointAddress{{IP: "2.2.2.2"}}, Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}, {Port: 53, Protocol: corev1.ProtocolUDP}}},
+		}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			gotSubsets, gotUpdate := buildSubsets(tt.subsets, tt.sources, tt.overwrite, tt.notReady)
+			// the next pass over the built subsets keeps them
+			if again, update := buildSubsets(append([]corev1.EndpointSubset{}, gotSubsets...), tt.sources, tt.overwrite, tt.notReady); len(gotSubsets) > 0 && (update || !reflect.DeepEqual(again, gotSubsets)) {
+				t.Errorf("buildSubsets() of the built subsets = %v, %v, want %v", again, update, gotSubsets)
+			}
 			if !reflect.DeepEqual(gotSubsets, tt.wantSubsets) {
 				t.Errorf("buildSubsets() gotSubsets = %v, want %v", gotSubsets, tt.wantSubsets)
 			}
@@ -110,3 +149,175 @@ func Test_buildSubsets(t *testing.T) {
 		})
 	}
 }
+
+func Test_hostKey(t *testing.T) {
+	ports := []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}, {Port: 53, Protocol: corev1.ProtocolUDP}}
+	tests := []struct {
+		key     hostKey
+		name    string
+		matches bool
+	}{
+		{hostKey{"1.1.1.1", 80, "TCP"}, "1.1.1.1:80", true},
+		{hostKey{"1.1.1.1", 53, "UDP"}, "1.1.1.1:53/UDP", true},
+		{hostKey{"1.1.1.1", 53, "TCP"}, "1.1.1.1:53", false},
+		{hostKey{"1.1.1.1", 443, "TCP"}, "1.1.1.1:443", false},
+	}
+	for _, tt := range tests {
+		if got := tt.key.String(); got != tt.name {
+			t.Errorf("String() = %v, want %v", got, tt.name)
+		}
+		if got := tt.key.matches(ports); got != tt.matches {
+			t.Errorf("%v.matches() = %v, want %v", tt.key, got, tt.matches)
+		}
+	}
+}
+
+func Test_probeMode_combine(t *testing.T) {
+	tests := []struct {
+		mode       string
+		counts     probeCounts
+		wantStatus bool
+		wantOK     bool
+	}{
+		{"all", probeCounts{total: 2, passed: 2}, true, true},
+		{"all", probeCounts{total: 2, passed: 1, failed: 1}, false, true},
+		{"all", probeCounts{total: 2}, false, false},
+		{"any", probeCounts{total: 2, passed: 1, failed: 1}, true, true},
+		{"any", probeCounts{total: 2, failed: 1}, false, true},
+		{"any", probeCounts{total: 2, neutral: 2}, false, false},
+		{"quorum:2", probeCounts{total: 3, passed: 2, failed: 1}, true, true},
+		{"quorum:2", probeCounts{total: 3, passed: 1, failed: 1}, false, false},
+		{"quorum:2", probeCounts{total: 3, passed: 1, failed: 2}, false, true},
+		{"quorum:2", probeCounts{total: 3, passed: 1, neutral: 2}, false, true},
+		{"quorum:4", probeCounts{total: 3}, false, false},
+		{"quorum:4", probeCounts{total: 3, passed: 3}, false, true},
+	}
+	for _, tt := range tests {
+		mode, err := parseProbeMode(tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotStatus, gotOK := mode.combine(tt.counts); gotStatus != tt.wantStatus || gotOK != tt.wantOK {
+			t.Errorf("%s.combine(%+v) = %v, %v, want %v, %v", tt.mode, tt.counts, gotStatus, gotOK, tt.wantStatus, tt.wantOK)
+		}
+	}
+	for _, invalid := range []string{"", "none", "quorum", "quorum:0", "quorum:x"} {
+		if mode, err := parseProbeMode(invalid); err == nil || mode.mode != ProbeModeAll {
+			t.Errorf("parseProbeMode(%q) = %v, %v, want error and all", invalid, mode, err)
+		}
+	}
+}
+
+// fakeStatusUpdater reports fixed probe weights
+type fakeStatusUpdater struct {
+	prober.StatusUpdater
+	weights map[interface{}]int
+}
+
+func (u fakeStatusUpdater) Status(key interface{}) (interface{}, bool) {
+	weight, ok := u.weights[key]
+	return prober.SimpleStatusResult(weight), ok
+}
+
+// testTarget has a subset of addresses on port 80 with a probe each, the first failed ones failing
+func testTarget(addresses, failed int) *targetRecord {
+	c, key, subset := &endpointsImporter{}, objectKey{"default", "test"}, corev1.EndpointSubset{Ports: []corev1.EndpointPort{{Port: 80, Protocol: corev1.ProtocolTCP}}}
+	h, weights := &targetRecord{c: c, key: key, probes: map[probeKey]prober.StatusProber{}}, map[interface{}]int{}
+	for i := 0; i < addresses; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i+1)
+		subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{IP: ip})
+		probe := probeKey{key, hostKey{ip, 80, "TCP"}, "tcp"}
+		h.probes[probe], weights[probe] = nil, 1
+		if i < failed {
+			weights[probe] = -1
+		}
+	}
+	c.statusUpdater = fakeStatusUpdater{weights: weights}
+	return h.updateSubsets([]corev1.EndpointSubset{subset})
+}
+
+func testThreshold(val string) *intstr.IntOrString {
+	if val == "" {
+		return nil
+	}
+	threshold := intstr.Parse(val)
+	return &threshold
+}
+
+func Test_targetRecord_buildSubsets_minReady(t *testing.T) {
+	tests := []struct {
+		minReady     string
+		failed       int
+		wantReady    int
+		wantUpdate   bool
+		wantPanicked bool
+	}{
+		{"", 3, 0, true, false},
+		{"2", 1, 2, true, false},
+		{"2", 2, 3, false, true},
+		{"50%", 1, 2, true, false},
+		{"50%", 2, 3, false, true},
+		{"100%", 0, 3, false, false},
+	}
+	for _, tt := range tests {
+		h := testTarget(3, tt.failed)
+		h.minReady = testThreshold(tt.minReady)
+		subsets, update := h.buildSubsets()
+		if got := len(subsets[0].Addresses); got != tt.wantReady || update != tt.wantUpdate || h.panicMode != tt.wantPanicked {
+			t.Errorf("min-ready=%s, %d failed: ready = %v, update = %v, panic = %v, want %v, %v, %v",
+				tt.minReady, tt.failed, got, update, h.panicMode, tt.wantReady, tt.wantUpdate, tt.wantPanicked)
+		}
+	}
+	for _, invalid := range []string{"x", "-1", "10.5%"} {
+		if _, err := parseThreshold("min-ready", invalid); err == nil {
+			t.Errorf("parseThreshold(%q) want error", invalid)
+		}
+	}
+}
+
+func Test_targetRecord_buildSubsets_maxUnavailable(t *testing.T) {
+	tests := []struct {
+		maxUnavailable  string
+		removalInterval time.Duration
+		failed          int
+		wantReady       []int
+	}{
+		{"", 0, 5, []int{5, 5, 5}},
+		{"2", 0, 5, []int{8, 8, 8}},
+		{"30%", 0, 5, []int{7, 7, 7}},
+		{"", time.Hour, 3, []int{9, 9, 9}},
+		{"1", time.Hour, 3, []int{9, 9, 9}},
+	}
+	for _, tt := range tests {
+		h := testTarget(10, tt.failed)
+		h.maxUnavailable, h.removalInterval = testThreshold(tt.maxUnavailable), tt.removalInterval
+		for pass, want := range tt.wantReady {
+			subsets, _ := h.buildSubsets()
+			if got := len(subsets[0].Addresses); got != want {
+				t.Errorf("max-unavailable=%s removal-interval=%v pass %d: ready = %v, want %v", tt.maxUnavailable, tt.removalInterval, pass, got, want)
+			}
+			h.updateSubsets(subsets)
+		}
+		if wantWait := tt.removalInterval > 0; (h.removalWait > 0) != wantWait {
+			t.Errorf("max-unavailable=%s removal-interval=%v: removalWait = %v", tt.maxUnavailable, tt.removalInterval, h.removalWait)
+		}
+	}
+}
+
+func Test_withAppProtocols(t *testing.T) {
+	ports := []corev1.EndpointPort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}, {Port: 53, Protocol: corev1.ProtocolUDP}}
+	got, err := withAppProtocols(ports, map[string]string{appProtocolKey("http", 80, corev1.ProtocolTCP): "kubernetes.io/h2c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{
+		map[string]interface{}{"name": "http", "port": float64(80), "protocol": "TCP", "appProtocol": "kubernetes.io/h2c"},
+		map[string]interface{}{"port": float64(53), "protocol": "UDP"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withAppProtocols() = %v, want %v", got, want)
+	}
+	if got, _ := withAppProtocols(ports, nil); !reflect.DeepEqual(got, ports) {
+		t.Errorf("withAppProtocols() without appProtocols = %v, want %v", got, ports)
+	}
+}
@@ -2,10 +2,18 @@ package controller
 
 import (
 	"context"
+	"time"
 
 	ptypes "k8s.io/apimachinery/pkg/types"
 )
 
+// targetWrite is a write of an update to the apiserver, built under the lock and written without it so that slow
+// writes do not block events and probes; done records the result of the write under the lock
+type targetWrite struct {
+	write func() error
+	done  func(err error) error
+}
+
 func (c *endpointsImporter) notifyUpdate(key objectKey) {
 	c.updateQueue.Add(key)
 }
@@ -16,22 +24,110 @@ func (c *endpointsImporter) processUpdates(ctx context.Context) bool {
 		return false
 	}
 	defer c.updateQueue.Done(item)
-	target, targetOK := c.targets[item.(objectKey)]
-	if !targetOK {
+	key := item.(objectKey)
+	target, writes, err := c.buildWrites(key)
+	if target == nil {
 		return false
 	}
-	patch, patchOK, err := target.buildPatch()
 	if err == nil {
-		if patchOK {
-			_, err = c.client.Resource(c.resource, target.key.namespace).Patch(target.key.name, ptypes.MergePatchType, patch)
-			c.logger.Printf("%s/%s: updated", target.key.namespace, target.key.name)
-		}
-		if err == nil {
-			c.updateQueue.Forget(item)
-			return true
-		}
+		err = c.runWrites(target, writes)
+	}
+	if err == nil {
+		c.updateQueue.Forget(item)
+		return true
 	}
-	c.logger.Printf("error processing %s/%s: (retries %d) %v", target.key.namespace, target.key.name, c.updateQueue.NumRequeues(item), err)
+	c.logger.Printf("error processing %s/%s: (retries %d) %v", key.namespace, key.name, c.updateQueue.NumRequeues(item), err)
+	c.metrics.retries.Inc()
 	c.updateQueue.AddRateLimited(item)
 	return true
 }
+
+// buildWrites builds the writes of the target of key in order: the Endpoints, EndpointSlices, Service and import status
+func (c *endpointsImporter) buildWrites(key objectKey) (*targetRecord, []targetWrite, error) {
+	c.Lock()
+	defer c.Unlock()
+	target, targetOK := c.targets[key]
+	if !targetOK {
+		return nil, nil, nil
+	}
+	now, lastSubsets := time.Now(), target.lastSubsets()
+	subsets, update := target.buildSubsets()
+	if target.removalWait > 0 {
+		c.updateQueue.AddAfter(key, target.removalWait)
+	}
+	status, statusSignature, statusWait := target.statusToPatch(now)
+	if statusWait > 0 {
+		c.updateQueue.AddAfter(key, statusWait)
+	}
+	patch, patchOK, err := target.buildPatch(subsets, update, status)
+	if err != nil {
+		return target, nil, err
+	}
+	endpointsWrite := targetWrite{done: func(err error) error {
+		if err == nil {
+			target.statusPatchedAt(statusSignature, now)
+		}
+		return nil
+	}}
+	if patchOK {
+		endpointsWrite.write = func() error {
+			_, err := c.client.Resource(c.resource, key.namespace).Patch(key.name, ptypes.MergePatchType, patch)
+			c.metrics.patched(key, "endpoints", err)
+			c.logger.Printf("%s/%s: updated", key.namespace, key.name)
+			return err
+		}
+	}
+	writes := []targetWrite{endpointsWrite}
+	if c.Output.EndpointSlices() {
+		slicesWrite, err := target.endpointSlicesWrite(subsets)
+		if err != nil {
+			return target, nil, err
+		}
+		writes = append(writes, slicesWrite)
+	}
+	statusWrite, importStatusWait, err := target.importStatusWrite(subsets, now)
+	if err != nil {
+		return target, nil, err
+	}
+	if importStatusWait > 0 {
+		c.updateQueue.AddAfter(key, importStatusWait)
+	}
+	serviceWrite, err := target.serviceWrite(subsets)
+	if err != nil {
+		return target, nil, err
+	}
+	return target, append(writes, serviceWrite, targetWrite{done: func(err error) error {
+		target.recordTransitions(lastSubsets, subsets)
+		return nil
+	}}, statusWrite), nil
+}
+
+// runWrites writes until the first error, then records the results under the lock unless the target was removed
+// or replaced meanwhile
+func (c *endpointsImporter) runWrites(target *targetRecord, writes []targetWrite) error {
+	var err error
+	written := 0
+	for ; written < len(writes) && err == nil; written++ {
+		if writes[written].write != nil {
+			err = writes[written].write()
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.targets[target.key] != target {
+		return err
+	}
+	for i, w := range writes[:written] {
+		if w.done == nil {
+			continue
+		}
+		var writeErr error
+		if i == written-1 {
+			writeErr = err
+		}
+		if doneErr := w.done(writeErr); doneErr != nil && err == nil {
+			err = doneErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_endpointsImporter_runWrites(t *testing.T) {
+	target := testTarget(1, 0)
+	c, failed := target.c, errors.New("failed")
+	c.targets = map[objectKey]*targetRecord{target.key: target}
+	written, done := []int{}, map[int]error{}
+	write := func(i int, err error) targetWrite {
+		return targetWrite{
+			write: func() error {
+				written = append(written, i)
+				return err
+			},
+			done: func(err error) error {
+				done[i] = err
+				return nil
+			},
+		}
+	}
+	if err := c.runWrites(target, []targetWrite{write(0, nil), {}, write(2, failed), write(3, nil)}); err != failed {
+		t.Errorf("runWrites() = %v, want %v", err, failed)
+	}
+	if want := []int{0, 2}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written = %v, want %v", written, want)
+	}
+	if want := map[int]error{0: nil, 2: failed}; !reflect.DeepEqual(done, want) {
+		t.Errorf("done = %v, want %v", done, want)
+	}
+
+	// results of writes of a removed target are not recorded
+	written, done = []int{}, map[int]error{}
+	delete(c.targets, target.key)
+	if err := c.runWrites(target, []targetWrite{write(0, nil)}); err != nil || len(written) != 1 || len(done) != 0 {
+		t.Errorf("runWrites() of a removed target = %v, written %v, done %v", err, written, done)
+	}
+}
@@ -1,6 +1,7 @@
 package fluconf
 
 import (
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -39,25 +40,73 @@ func parseToken(token string) (key string, val string, ok bool) {
 	return key, val, true
 }
 
-// Parse func
-func Parse(conf string, entryKey string, shared Config) []Config {
+// Parse func, a key repeated in an entry keeps its last value, unless it is one of multiValueKeys whose values are
+// joined by newlines, see GetStrings
+func Parse(conf string, entryKey string, shared Config, multiValueKeys ...string) []Config {
 	if shared == nil {
 		shared = Config{}
 	}
-	entry, entries := shared, []Config{}
+	multiValue := map[string]bool{}
+	for _, key := range multiValueKeys {
+		multiValue[key] = true
+	}
+	entry, entries, seen := shared, []Config{}, map[string]bool{}
 	for _, token := range tokenize(conf) {
 		if key, val, ok := parseToken(token); ok {
-			if key == "" {
-				entry = shared.CopyWith(entryKey, val)
+			switch {
+			case key == "":
+				entry, seen = shared.CopyWith(entryKey, val), map[string]bool{}
 				entries = append(entries, entry)
-			} else {
-				entry[key] = val
+			case seen[key] && multiValue[key]:
+				entry[key] += "\n" + val
+			default:
+				entry[key], seen[key] = val, true
 			}
 		}
 	}
 	return entries
 }
 
+func formatToken(val string) string {
+	if val == "" || strings.IndexFunc(val, func(c rune) bool {
+		return unicode.IsSpace(c) || unicode.In(c, unicode.Quotation_Mark)
+	}) >= 0 {
+		return strconv.Quote(val)
+	}
+	return val
+}
+
+func formatOptions(tokens []string, entry Config, entryKey string) string {
+	keys := make([]string, 0, len(entry))
+	for key := range entry {
+		if key != entryKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tokens = append(tokens, key+"="+formatToken(entry[key]))
+	}
+	return strings.Join(tokens, " ")
+}
+
+// Format func, the reverse of Parse
+func Format(entries []Config, entryKey string) string {
+	return FormatShared(nil, entries, entryKey)
+}
+
+// FormatShared func, the reverse of Parse with shared options preceding the first entry
+func FormatShared(shared Config, entries []Config, entryKey string) string {
+	lines := make([]string, 0, len(entries)+1)
+	if len(shared) > 0 {
+		lines = append(lines, formatOptions(nil, shared, entryKey))
+	}
+	for _, entry := range entries {
+		lines = append(lines, formatOptions([]string{formatToken(entry[entryKey])}, entry, entryKey))
+	}
+	return strings.Join(lines, "\n")
+}
+
 // Config type
 type Config map[string]string
 
@@ -69,6 +118,14 @@ func (c Config) GetString(name, defaultVal string) string {
 	return defaultVal
 }
 
+// GetStrings func, splits values of repeated multi-value keys, see Parse
+func (c Config) GetStrings(name string) []string {
+	if sval, ok := c[name]; ok {
+		return strings.Split(sval, "\n")
+	}
+	return nil
+}
+
 // GetInt func
 func (c Config) GetInt(name string, defaultVal int) int {
 	if sval, ok := c[name]; ok {
@@ -78,16 +78,58 @@ func TestParse(t *testing.T) {
 			`abc=123 test =invalid test=def`,
 			[]Config{{"probe": "test", "abc": "123", "test": "def"}},
 		},
+		{
+			"n7", Config{"header": "X-Shared:1"},
+			`http header=X-A:1 header="X-B: 2" uri=/ tcp header=X-C:3`,
+			[]Config{
+				{"probe": "http", "header": "X-A:1\nX-B: 2", "uri": "/"},
+				{"probe": "tcp", "header": "X-C:3"},
+			},
+		},
+		{
+			"n8", nil,
+			`http port=80 header=X-A:1 port=8080 header=X-B:2`,
+			[]Config{{"probe": "http", "port": "8080", "header": "X-A:1\nX-B:2"}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := Parse(tt.conf, "probe", tt.shared); !reflect.DeepEqual(got, tt.want) {
+			if got := Parse(tt.conf, "probe", tt.shared, "header"); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Parse() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func TestFormat(t *testing.T) {
+	entries := []Config{
+		{"probe": "http", "uri": "/xxx/xxx", "port": "80"},
+		{"probe": "exec", "command": "bash -c 'echo foo'", "timeout": "2000", "empty": ""},
+	}
+	conf := Format(entries, "probe")
+	if want := "http port=80 uri=/xxx/xxx\nexec command=\"bash -c 'echo foo'\" empty=\"\" timeout=2000"; conf != want {
+		t.Errorf("Format() = %v, want %v", conf, want)
+	}
+	if got := Parse(conf, "probe", nil); !reflect.DeepEqual(got, entries) {
+		t.Errorf("Parse(Format()) = %v, want %v", got, entries)
+	}
+}
+
+func TestFormatShared(t *testing.T) {
+	shared, entries := Config{"health-scope": "host"}, []Config{{"probe": "tcp", "port": "80"}}
+	conf := FormatShared(shared, entries, "probe")
+	if want := "health-scope=host\ntcp port=80"; conf != want {
+		t.Errorf("FormatShared() = %v, want %v", conf, want)
+	}
+	parsedShared := Config{}
+	if got, want := Parse(conf, "probe", parsedShared), []Config{{"probe": "tcp", "port": "80", "health-scope": "host"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(FormatShared()) = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(parsedShared, shared) {
+		t.Errorf("Parse(FormatShared()) shared = %v, want %v", parsedShared, shared)
+	}
+}
+
 func TestConfig_Get(t *testing.T) {
 	c := Config{"int": "12", "eint": "n/a", "str": "str"}
 	t.Run("Gets", func(t *testing.T) {
@@ -103,5 +145,11 @@ func TestConfig_Get(t *testing.T) {
 		if got, want := c.GetString("nostr", "nostr"), "nostr"; got != want {
 			t.Errorf("Config.GetString(nostr) = %v, want %v", got, want)
 		}
+		if got, want := c.GetStrings("str"), []string{"str"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Config.GetStrings(str) = %v, want %v", got, want)
+		}
+		if got := c.GetStrings("nostr"); got != nil {
+			t.Errorf("Config.GetStrings(nostr) = %v, want nil", got)
+		}
 	})
 }
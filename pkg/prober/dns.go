@@ -0,0 +1,265 @@
+package prober
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	kprobe "k8s.io/kubernetes/pkg/probe"
+)
+
+var (
+	dnsTypes = map[string]uint16{
+		"A": 1, "NS": 2, "CNAME": 5, "SOA": 6, "PTR": 12, "MX": 15, "TXT": 16, "AAAA": 28, "SRV": 33, "ANY": 255,
+	}
+	dnsRcodes = map[string]int{
+		"NOERROR": 0, "FORMERR": 1, "SERVFAIL": 2, "NXDOMAIN": 3, "NOTIMP": 4, "REFUSED": 5,
+	}
+)
+
+func dnsRcodeName(rcode int) string {
+	for name, code := range dnsRcodes {
+		if code == rcode {
+			return name
+		}
+	}
+	return strconv.Itoa(rcode)
+}
+
+// dnsAnswer is a resource record of the answer section, with rdata formatted by type
+type dnsAnswer struct {
+	rrType uint16
+	data   string
+}
+
+// dnsResponse is the parsed response of a query
+type dnsResponse struct {
+	id      uint16
+	rcode   int
+	answers []dnsAnswer
+}
+
+// encodeDNSQuery encodes a recursive query of one question in class IN
+func encodeDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	if name = strings.TrimSuffix(name, "."); name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("illegal name: %s", name)
+			}
+			msg = append(append(msg, byte(len(label))), label...)
+		}
+	}
+	msg = append(msg, 0, 0, 0, 0, 1)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	return msg, nil
+}
+
+// decodeDNSName decodes a possibly compressed name at offset, returning the offset after it
+func decodeDNSName(msg []byte, offset int) (string, int, error) {
+	labels, end := []string{}, -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("name out of range")
+		}
+		switch size := int(msg[offset]); {
+		case size == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case size&0xC0 == 0xC0:
+			if offset+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("illegal name pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset, jumps = int(binary.BigEndian.Uint16(msg[offset:])&0x3FFF), jumps+1
+		default:
+			if offset+1+size > len(msg) {
+				return "", 0, errors.New("label out of range")
+			}
+			labels, offset = append(labels, string(msg[offset+1:offset+1+size])), offset+1+size
+		}
+	}
+}
+
+func formatDNSData(msg []byte, rrType uint16, offset, size int) (string, error) {
+	rdata := msg[offset : offset+size]
+	switch rrType {
+	case dnsTypes["A"], dnsTypes["AAAA"]:
+		return net.IP(rdata).String(), nil
+	case dnsTypes["NS"], dnsTypes["CNAME"], dnsTypes["PTR"]:
+		name, _, err := decodeDNSName(msg, offset)
+		return name, err
+	case dnsTypes["MX"]:
+		if size < 2 {
+			return "", errors.New("illegal MX")
+		}
+		name, _, err := decodeDNSName(msg, offset+2)
+		return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), name), err
+	case dnsTypes["SRV"]:
+		if size < 6 {
+			return "", errors.New("illegal SRV")
+		}
+		name, _, err := decodeDNSName(msg, offset+6)
+		return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]), binary.BigEndian.Uint16(rdata[4:]), name), err
+	case dnsTypes["TXT"]:
+		texts := []string{}
+		for i := 0; i < len(rdata); i += 1 + int(rdata[i]) {
+			if i+1+int(rdata[i]) > len(rdata) {
+				return "", errors.New("illegal TXT")
+			}
+			texts = append(texts, string(rdata[i+1:i+1+int(rdata[i])]))
+		}
+		return strings.Join(texts, ""), nil
+	}
+	return fmt.Sprintf("%x", rdata), nil
+}
+
+// decodeDNSResponse decodes the header and answer section of a response
+func decodeDNSResponse(msg []byte) (*dnsResponse, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("message too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("not a response")
+	}
+	res := &dnsResponse{id: binary.BigEndian.Uint16(msg), rcode: int(flags & 0xF)}
+	qdcount, ancount, offset := int(binary.BigEndian.Uint16(msg[4:])), int(binary.BigEndian.Uint16(msg[6:])), 12
+	for i := 0; i < qdcount; i++ {
+		_, end, err := decodeDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = end + 4
+	}
+	for i := 0; i < ancount; i++ {
+		_, end, err := decodeDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if end+10 > len(msg) {
+			return nil, errors.New("answer out of range")
+		}
+		rrType, size := binary.BigEndian.Uint16(msg[end:]), int(binary.BigEndian.Uint16(msg[end+8:]))
+		if offset = end + 10; offset+size > len(msg) {
+			return nil, errors.New("answer out of range")
+		}
+		data, err := formatDNSData(msg, rrType, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		res.answers, offset = append(res.answers, dnsAnswer{rrType, data}), offset+size
+	}
+	return res, nil
+}
+
+// exchangeDNS sends the query over udp, or tcp with the 2-byte length prefix
+func exchangeDNS(ctx context.Context, network, addr string, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(msg))
+	_, err = io.ReadFull(conn, buf)
+	return buf, err
+}
+
+// loadDNSProbeFunc queries name=/type= (defaults to . NS), expects rcode= (defaults to NOERROR)
+// and an answer containing expect-answer= if given, over tcp=yes (defaults to yes for TCP ports) or udp
+func loadDNSProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error) {
+	ip, port := conf.GetString("ip", conf.GetString("host", "127.0.0.1")), conf.GetInt("port", 53)
+	name, qtypeName, network := conf.GetString("name", "."), strings.ToUpper(conf.GetString("type", "NS")), "udp"
+	if port <= 0 {
+		return nil, "", fmt.Errorf("illegal port: %v", port)
+	}
+	qtype, ok := dnsTypes[qtypeName]
+	if !ok {
+		return nil, "", fmt.Errorf("illegal type: %s", qtypeName)
+	}
+	rcodeName := strings.ToUpper(conf.GetString("rcode", "NOERROR"))
+	rcode, ok := dnsRcodes[rcodeName]
+	if !ok {
+		return nil, "", fmt.Errorf("illegal rcode: %s", rcodeName)
+	}
+	if _, err := encodeDNSQuery(0, name, qtype); err != nil {
+		return nil, "", err
+	}
+	if conf.GetBool("tcp", strings.EqualFold(conf["protocol"], "TCP")) {
+		network = "tcp"
+	}
+	addr, expectAnswer := net.JoinHostPort(ip, strconv.Itoa(port)), conf["expect-answer"]
+
+	return func(ctx context.Context, timeout time.Duration) (int, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		result, message := doDNSProbe(ctx, network, addr, name, qtype, rcode, expectAnswer)
+		SetProbeMessage(ctx, message)
+		return kprobeResultWeight(result, conf), nil
+	}, fmt.Sprintf("dns|%s/%s|%s %s", addr, network, name, qtypeName), nil
+}
+
+func doDNSProbe(ctx context.Context, network, addr, name string, qtype uint16, rcode int, expectAnswer string) (kprobe.Result, string) {
+	id := uint16(rand.Intn(1 << 16))
+	query, _ := encodeDNSQuery(id, name, qtype)
+	msg, err := exchangeDNS(ctx, network, addr, query)
+	if err != nil {
+		return kprobe.Failure, fmt.Sprintf("exchange: %v", err)
+	}
+	res, err := decodeDNSResponse(msg)
+	switch {
+	case err != nil:
+		return kprobe.Failure, fmt.Sprintf("response: %v", err)
+	case res.id != id:
+		return kprobe.Failure, fmt.Sprintf("response: id mismatch %d != %d", res.id, id)
+	case res.rcode != rcode:
+		return kprobe.Failure, fmt.Sprintf("rcode: %s", dnsRcodeName(res.rcode))
+	case expectAnswer == "":
+		return kprobe.Success, ""
+	}
+	answers := make([]string, len(res.answers))
+	for i, answer := range res.answers {
+		if strings.Contains(answer.data, expectAnswer) {
+			return kprobe.Success, ""
+		}
+		answers[i] = answer.data
+	}
+	return kprobe.Failure, fmt.Sprintf("answer: %q not found in [%s]", expectAnswer, strings.Join(answers, ", "))
+}
@@ -0,0 +1,99 @@
+package prober
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+// dnsTestResponse answers the query with rcode and A records of ips, pointing to the question name
+func dnsTestResponse(query []byte, rcode int, ips ...string) []byte {
+	res := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(res[2:], 0x8180|uint16(rcode))
+	binary.BigEndian.PutUint16(res[6:], uint16(len(ips)))
+	for _, ip := range ips {
+		rr := []byte{0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4}
+		res = append(append(res, rr...), net.ParseIP(ip).To4()...)
+	}
+	return res
+}
+
+func TestDNSProbe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			name, _, _ := decodeDNSName(query, 12)
+			switch name {
+			case "example.com.":
+				conn.WriteTo(dnsTestResponse(query, 0, "10.0.0.1", "10.0.0.2"), addr)
+			case "slow.example.com.":
+			default:
+				conn.WriteTo(dnsTestResponse(query, 3), addr)
+			}
+		}
+	}()
+	ip, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	tests := []struct {
+		conf    fluconf.Config
+		want    int
+		message string
+	}{
+		{fluconf.Config{"name": "example.com", "type": "A"}, 1, ""},
+		{fluconf.Config{"name": "example.com.", "type": "a", "expect-answer": "10.0.0.2"}, 1, ""},
+		{fluconf.Config{"name": "example.com", "expect-answer": "10.0.0.3"}, -1, `answer: "10.0.0.3" not found in [10.0.0.1, 10.0.0.2]`},
+		{fluconf.Config{"name": "missing.example.com"}, -1, "rcode: NXDOMAIN"},
+		{fluconf.Config{"name": "missing.example.com", "rcode": "nxdomain"}, 1, ""},
+		{fluconf.Config{"name": "slow.example.com"}, -1, "exchange:"},
+	}
+	for _, tt := range tests {
+		conf := fluconf.Config{"probe": "dns", "ip": ip, "port": port, "protocol": "UDP"}.CopyWithAll(tt.conf)
+		got, message, err := probeWithMessage(conf)
+		if err != nil || got != tt.want || !strings.HasPrefix(message, tt.message) || (tt.message == "" && message != "") {
+			t.Errorf("probe %v = %v, %q, %v, want %v, %q", tt.conf, got, message, err, tt.want, tt.message)
+		}
+	}
+
+	for _, conf := range []fluconf.Config{
+		{"probe": "dns", "type": "BOGUS"},
+		{"probe": "dns", "rcode": "BOGUS"},
+		{"probe": "dns", "name": "a..b"},
+	} {
+		if _, _, err := LoadSimpleStatusProbeFunc(conf); err == nil {
+			t.Errorf("LoadSimpleStatusProbeFunc(%v) succeeded", conf)
+		}
+	}
+}
+
+func Test_decodeDNSResponse(t *testing.T) {
+	query, _ := encodeDNSQuery(1, "_sip._udp.example.com", dnsTypes["SRV"])
+	res := dnsTestResponse(query, 0)
+	binary.BigEndian.PutUint16(res[6:], 2)
+	res = append(res, 0xC0, 12, 0, 33, 0, 1, 0, 0, 0, 60, 0, 12, 0, 10, 0, 20, 0x13, 0xC4, 3, 's', 'i', 'p', 0xC0, 22)
+	res = append(res, 0xC0, 12, 0, 16, 0, 1, 0, 0, 0, 60, 0, 6, 2, 'a', 'b', 2, 'c', 'd')
+	got, err := decodeDNSResponse(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.answers) != 2 || got.answers[0].data != "10 20 5060 sip.example.com." || got.answers[1].data != "abcd" {
+		t.Errorf("decodeDNSResponse() answers = %v", got.answers)
+	}
+	for _, invalid := range [][]byte{res[:10], query, res[:len(res)-3], append(res[:len(query)-6], 0xC0, 0xFF)} {
+		if _, err := decodeDNSResponse(invalid); err == nil {
+			t.Errorf("decodeDNSResponse(%x) succeeded", invalid)
+		}
+	}
+}
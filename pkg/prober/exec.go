@@ -0,0 +1,132 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaopal/kube-informer/pkg/subreaper"
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	kprobe "k8s.io/kubernetes/pkg/probe"
+)
+
+// DefaultExecMaxOutput bytes of stdout/stderr kept for diagnostics
+const DefaultExecMaxOutput = 1024
+
+// limitedBuffer keeps the first limit bytes written
+type limitedBuffer struct {
+	sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if remain := b.limit - b.buf.Len(); remain < len(p) {
+		if remain > 0 {
+			b.buf.Write(p[:remain])
+		}
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	if b.truncated {
+		return b.buf.String() + "...(truncated)"
+	}
+	return b.buf.String()
+}
+
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, key)
+}
+
+// execEnv exports conf keys as environment variables, eg. host -> HOST, max-output -> MAX_OUTPUT
+func execEnv(conf fluconf.Config) []string {
+	env := os.Environ()
+	for key, val := range conf {
+		env = append(env, fmt.Sprintf("%s=%s", envName(key), val))
+	}
+	return env
+}
+
+// execWaitDelay bounds waiting for the output once the command exited, as children left in the background,
+// eg. daemons, may hold the output open
+const execWaitDelay = time.Second
+
+// runExec runs the command with sh, killing its process group when ctx is done
+func runExec(ctx context.Context, command string, env []string, maxOutput int) (kprobe.Result, string, error) {
+	output := &limitedBuffer{limit: maxOutput}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env, cmd.Stdout, cmd.Stderr, cmd.WaitDelay = env, output, output, execWaitDelay
+	setProcessGroup(cmd)
+
+	// keep the subreaper from reaping the child before Wait
+	subreaper.Pause()
+	if err := cmd.Start(); err != nil {
+		subreaper.Resume()
+		return kprobe.Unknown, "", err
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer subreaper.Resume()
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		switch err.(type) {
+		case nil:
+			return kprobe.Success, output.String(), nil
+		case *exec.ExitError:
+			return kprobe.Failure, output.String(), nil
+		}
+		if err == exec.ErrWaitDelay {
+			return kprobe.Success, output.String(), nil
+		}
+		return kprobe.Unknown, output.String(), err
+	case <-ctx.Done():
+		// Wait is left to the goroutine, so that the timeout bounds the probe even if the output is held open
+		killProcessGroup(cmd)
+		return kprobe.Unknown, output.String(), ctx.Err()
+	}
+}
+
+func loadExecProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error) {
+	command, maxOutput := conf.GetString("command", ""), conf.GetInt("max-output", DefaultExecMaxOutput)
+	if command == "" {
+		return nil, "", fmt.Errorf("illegal command: %q", command)
+	}
+	env := execEnv(conf)
+	return func(ctx context.Context, timeout time.Duration) (int, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		result, output, err := runExec(ctx, command, env, maxOutput)
+		if err != nil {
+			output = strings.TrimSpace(fmt.Sprintf("%v: %s", err, output))
+		}
+		SetProbeMessage(ctx, output)
+		return kprobeResultWeight(result, conf), nil
+	}, fmt.Sprintf("exec|%s:%s|%s", conf.GetString("ip", conf["host"]), conf["port"], command), nil
+}
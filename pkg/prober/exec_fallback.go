@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package prober
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
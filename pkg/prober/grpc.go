@@ -0,0 +1,191 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"golang.org/x/net/http2"
+	kprobe "k8s.io/kubernetes/pkg/probe"
+)
+
+const (
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	maxGRPCMessage      = 64 * 1024
+)
+
+// grpcServingStatus of grpc.health.v1.HealthCheckResponse
+var grpcServingStatus = map[uint64]string{0: "UNKNOWN", 1: "SERVING", 2: "NOT_SERVING", 3: "SERVICE_UNKNOWN"}
+
+// encodeHealthCheckRequest encodes grpc.health.v1.HealthCheckRequest{service} as a length-prefixed message
+func encodeHealthCheckRequest(service string) []byte {
+	msg := proto.NewBuffer(nil)
+	if service != "" {
+		msg.EncodeVarint(1<<3 | proto.WireBytes)
+		msg.EncodeStringBytes(service)
+	}
+	frame := make([]byte, 5, 5+len(msg.Bytes()))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg.Bytes())))
+	return append(frame, msg.Bytes()...)
+}
+
+// decodeHealthCheckResponse decodes the status field of grpc.health.v1.HealthCheckResponse
+func decodeHealthCheckResponse(msg []byte) (status uint64, err error) {
+	for len(msg) > 0 {
+		key, n := proto.DecodeVarint(msg)
+		if n == 0 {
+			return 0, errors.New("illegal message")
+		}
+		msg = msg[n:]
+		switch wireType := key & 7; {
+		case key == 1<<3|proto.WireVarint:
+			if status, n = proto.DecodeVarint(msg); n == 0 {
+				return 0, errors.New("illegal status")
+			}
+		case wireType == proto.WireVarint:
+			_, n = proto.DecodeVarint(msg)
+		case wireType == proto.WireFixed64:
+			n = 8
+		case wireType == proto.WireFixed32:
+			n = 4
+		case wireType == proto.WireBytes:
+			var size uint64
+			size, n = proto.DecodeVarint(msg)
+			n += int(size)
+		default:
+			return 0, fmt.Errorf("illegal wire type %d", wireType)
+		}
+		if n == 0 || n > len(msg) {
+			return 0, errors.New("illegal message")
+		}
+		msg = msg[n:]
+	}
+	return status, nil
+}
+
+// readGRPCMessage reads the first length-prefixed message of the response body
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed message not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxGRPCMessage {
+		return nil, fmt.Errorf("message too large: %d", size)
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(body, msg)
+	return msg, err
+}
+
+// grpcStatus returns grpc-status and grpc-message from trailers, or headers of trailers-only responses
+func grpcStatus(res *http.Response) (string, string) {
+	if status := res.Trailer.Get("Grpc-Status"); status != "" {
+		return status, res.Trailer.Get("Grpc-Message")
+	}
+	return res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+}
+
+func doGRPCProbe(ctx context.Context, client *http.Client, u *url.URL, service string) (kprobe.Result, string) {
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(encodeHealthCheckRequest(service)))
+	if err != nil {
+		return kprobe.Failure, fmt.Sprintf("request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		var handshakeErr handshakeError
+		if errors.As(err, &handshakeErr) {
+			return kprobe.Failure, fmt.Sprintf("handshake: %v", handshakeErr.error)
+		}
+		return kprobe.Failure, fmt.Sprintf("connect: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return kprobe.Failure, fmt.Sprintf("status: %s", res.Status)
+	}
+	msg, msgErr := readGRPCMessage(res.Body)
+	io.Copy(ioutil.Discard, res.Body)
+	if status, message := grpcStatus(res); status != "0" {
+		return kprobe.Failure, fmt.Sprintf("grpc-status: %s %s", status, message)
+	}
+	if msgErr != nil {
+		return kprobe.Failure, fmt.Sprintf("response: %v", msgErr)
+	}
+	status, err := decodeHealthCheckResponse(msg)
+	if err != nil {
+		return kprobe.Failure, fmt.Sprintf("response: %v", err)
+	}
+	switch name := grpcServingStatus[status]; name {
+	case "SERVING":
+		return kprobe.Success, ""
+	case "NOT_SERVING":
+		return kprobe.Failure, name
+	case "":
+		return kprobe.Unknown, strconv.FormatUint(status, 10)
+	default:
+		return kprobe.Unknown, name
+	}
+}
+
+// loadGRPCProbeFunc checks grpc.health.v1.Health/Check, over TLS if tls=yes
+func loadGRPCProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error) {
+	host, port, service := conf.GetString("host", "127.0.0.1"), conf.GetInt("port", 0), conf.GetString("service", "")
+	ip, useTLS := conf.GetString("ip", host), conf.GetBool("tls", false)
+	if port <= 0 {
+		return nil, "", fmt.Errorf("illegal port: %v", port)
+	}
+	scheme, authority, addr := "http", net.JoinHostPort(host, strconv.Itoa(port)), net.JoinHostPort(ip, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: conf.GetDuration("timeout", 10*time.Second)}
+	dial := func(network, _ string, _ *tls.Config) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}
+	if useTLS {
+		tlsConf := conf
+		if _, ok := conf["sni"]; !ok && host != ip {
+			tlsConf = conf.CopyWith("sni", host)
+		}
+		tlsConfig, err := LoadTLSConfig(tlsConf)
+		if err != nil {
+			return nil, "", err
+		}
+		tlsConfig.NextProtos, scheme = []string{http2.NextProtoTLS}, "https"
+		dialTLS := dialTLS(tlsConfig)
+		dial = func(network, _ string, _ *tls.Config) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout)
+			defer cancel()
+			return dialTLS(ctx, network, addr)
+		}
+	}
+	u := &url.URL{Scheme: scheme, Host: authority, Path: grpcHealthCheckPath}
+
+	return func(ctx context.Context, timeout time.Duration) (int, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		// a connection per probe, as the http probe
+		transport := &http2.Transport{AllowHTTP: true, DialTLS: dial}
+		defer transport.CloseIdleConnections()
+		result, message := doGRPCProbe(ctx, &http.Client{Transport: transport}, u, service)
+		SetProbeMessage(ctx, message)
+		return kprobeResultWeight(result, conf), nil
+	}, fmt.Sprintf("grpc|%s|%s", addr, service), nil
+}
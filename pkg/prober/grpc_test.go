@@ -0,0 +1,113 @@
+package prober
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	"golang.org/x/net/http2"
+)
+
+// grpcHealthHandler serves grpc.health.v1.Health/Check with the status of each service
+func grpcHealthHandler(statuses map[string]uint64) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != grpcHealthCheckPath || req.Header.Get("Content-Type") != "application/grpc" {
+			res.WriteHeader(404)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		service, msg := "", proto.NewBuffer(body[5:])
+		if len(body) > 5 {
+			msg.DecodeVarint()
+			service, _ = msg.DecodeStringBytes()
+		}
+		res.Header().Set("Content-Type", "application/grpc")
+		status, ok := statuses[service]
+		if !ok {
+			res.Header().Set("Grpc-Status", "5")
+			res.Header().Set("Grpc-Message", "unknown service")
+			res.WriteHeader(200)
+			return
+		}
+		out := proto.NewBuffer(nil)
+		out.EncodeVarint(1<<3 | proto.WireVarint)
+		out.EncodeVarint(status)
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(out.Bytes())))
+		res.WriteHeader(200)
+		res.Write(append(frame, out.Bytes()...))
+		res.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+}
+
+func TestGRPCProbe(t *testing.T) {
+	handler := grpcHealthHandler(map[string]uint64{"": 1, "down": 2, "unknown": 0, "future": 9})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+	ts := httptest.NewUnstartedServer(handler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	_, tlsPort, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	tests := []struct {
+		conf    fluconf.Config
+		want    int
+		message string
+	}{
+		{fluconf.Config{}, 1, ""},
+		{fluconf.Config{"service": "down"}, -1, "NOT_SERVING"},
+		{fluconf.Config{"service": "down", "failure": "-2"}, -2, "NOT_SERVING"},
+		{fluconf.Config{"service": "unknown", "unknown": "0"}, 0, "UNKNOWN"},
+		{fluconf.Config{"service": "future"}, -1, "9"},
+		{fluconf.Config{"service": "missing"}, -1, "grpc-status: 5 unknown service"},
+		{fluconf.Config{"port": "1"}, -1, "connect:"},
+		{fluconf.Config{"port": tlsPort, "tls": "yes", "insecure": "yes"}, 1, ""},
+		{fluconf.Config{"port": tlsPort, "tls": "yes", "insecure": "yes", "service": "down"}, -1, "NOT_SERVING"},
+		{fluconf.Config{"port": tlsPort, "tls": "yes"}, -1, "handshake:"},
+	}
+	for _, tt := range tests {
+		conf := fluconf.Config{"probe": "grpc", "ip": "127.0.0.1", "host": "127.0.0.1", "port": port}.CopyWithAll(tt.conf)
+		got, message, err := probeWithMessage(conf)
+		if err != nil || got != tt.want || !strings.HasPrefix(message, tt.message) || (tt.message == "" && message != "") {
+			t.Errorf("probe %v = %v, %q, %v, want %v, %q", tt.conf, got, message, err, tt.want, tt.message)
+		}
+	}
+
+	if _, _, err := LoadSimpleStatusProbeFunc(fluconf.Config{"probe": "grpc"}); err == nil {
+		t.Errorf("LoadSimpleStatusProbeFunc() without port succeeded")
+	}
+}
+
+func Test_decodeHealthCheckResponse(t *testing.T) {
+	msg := proto.NewBuffer(nil)
+	msg.EncodeVarint(2<<3 | proto.WireBytes)
+	msg.EncodeStringBytes("ignored")
+	msg.EncodeVarint(1<<3 | proto.WireVarint)
+	msg.EncodeVarint(2)
+	if status, err := decodeHealthCheckResponse(msg.Bytes()); err != nil || status != 2 {
+		t.Errorf("decodeHealthCheckResponse() = %v, %v, want 2", status, err)
+	}
+	if _, err := decodeHealthCheckResponse([]byte{1<<3 | proto.WireBytes, 10}); err == nil {
+		t.Errorf("decodeHealthCheckResponse() of truncated message succeeded")
+	}
+}
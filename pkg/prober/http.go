@@ -0,0 +1,321 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	kprobe "k8s.io/kubernetes/pkg/probe"
+	"k8s.io/kubernetes/pkg/version"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// handshakeError is a failed TLS handshake, distinguished from connection and HTTP status failures
+type handshakeError struct {
+	error
+}
+
+// loadPEM reads inline PEM from dataKey or a PEM file from fileKey
+func loadPEM(conf fluconf.Config, fileKey, dataKey string) ([]byte, error) {
+	if data, ok := conf[dataKey]; ok {
+		return []byte(data), nil
+	}
+	if file, ok := conf[fileKey]; ok {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// LoadTLSConfig builds the client TLS config of https probes, and other clients of the same options
+func LoadTLSConfig(conf fluconf.Config) (*tls.Config, error) {
+	config := &tls.Config{ServerName: conf["sni"], InsecureSkipVerify: conf.GetBool("insecure", false)}
+	ca, err := loadPEM(conf, "ca", "ca-data")
+	if err != nil {
+		return nil, fmt.Errorf("illegal ca: %v", err)
+	}
+	if ca != nil {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("illegal ca: no certificates found")
+		}
+	}
+	cert, err := loadPEM(conf, "cert", "cert-data")
+	if err != nil {
+		return nil, fmt.Errorf("illegal cert: %v", err)
+	}
+	key, err := loadPEM(conf, "key", "key-data")
+	if err != nil {
+		return nil, fmt.Errorf("illegal key: %v", err)
+	}
+	switch {
+	case cert != nil && key != nil:
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("illegal cert or key: %v", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	case cert != nil || key != nil:
+		return nil, fmt.Errorf("cert and key required together")
+	}
+	if v, ok := conf["min-tls-version"]; ok {
+		if config.MinVersion, ok = tlsVersions[v]; !ok {
+			return nil, fmt.Errorf("illegal min-tls-version: %s", v)
+		}
+	}
+	return config, nil
+}
+
+// dialTLS returns a DialTLSContext func wrapping handshake failures as handshakeError
+func dialTLS(config *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		connConfig := config.Clone()
+		if connConfig.ServerName == "" {
+			connConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, connConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, handshakeError{err}
+		}
+		return tlsConn, nil
+	}
+}
+
+func redirectChecker(req *http.Request, via []*http.Request) error {
+	if req.URL.Hostname() != via[0].URL.Hostname() {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// maxHTTPBody bytes of the response body matched against expect-body
+const maxHTTPBody = 64 * 1024
+
+var (
+	httpMethodPattern = regexp.MustCompile(`^[A-Z]+$`)
+	httpStatusPattern = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+)
+
+// httpExpect is the expected response of http probes
+type httpExpect struct {
+	statuses  []string
+	body      string
+	bodyRegex *regexp.Regexp
+}
+
+// loadHTTPExpect parses expect-status=200,204,3xx, expect-body=substring and expect-body-regex=regex
+func loadHTTPExpect(conf fluconf.Config) (*httpExpect, error) {
+	expect := &httpExpect{body: conf["expect-body"]}
+	if statuses, ok := conf["expect-status"]; ok {
+		for _, status := range strings.Split(statuses, ",") {
+			if status = strings.ToLower(strings.TrimSpace(status)); !httpStatusPattern.MatchString(status) {
+				return nil, fmt.Errorf("illegal expect-status: %s", statuses)
+			}
+			expect.statuses = append(expect.statuses, status)
+		}
+	}
+	if pattern, ok := conf["expect-body-regex"]; ok {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("illegal expect-body-regex: %v", err)
+		}
+		expect.bodyRegex = regex
+	}
+	return expect, nil
+}
+
+// status checks the status code, by default 2xx is success and 3xx is warning
+func (e *httpExpect) status(code int) kprobe.Result {
+	if len(e.statuses) == 0 {
+		switch {
+		case code >= http.StatusOK && code < http.StatusMultipleChoices:
+			return kprobe.Success
+		case code >= http.StatusMultipleChoices && code < http.StatusBadRequest:
+			return kprobe.Warning
+		}
+		return kprobe.Failure
+	}
+	scode := strconv.Itoa(code)
+	for _, status := range e.statuses {
+		if status == scode || (strings.HasSuffix(status, "xx") && status[0] == scode[0]) {
+			return kprobe.Success
+		}
+	}
+	return kprobe.Failure
+}
+
+func (e *httpExpect) matchBody() bool {
+	return e.body != "" || e.bodyRegex != nil
+}
+
+// checkBody returns why the body does not match, or an empty string
+func (e *httpExpect) checkBody(body []byte) string {
+	switch {
+	case e.body != "" && !strings.Contains(string(body), e.body):
+		return fmt.Sprintf("body: %q not found", e.body)
+	case e.bodyRegex != nil && !e.bodyRegex.Match(body):
+		return fmt.Sprintf("body: /%s/ not matched", e.bodyRegex)
+	}
+	return ""
+}
+
+// LoadHeader parses header= of "Name: value", repeated for each header
+func LoadHeader(conf fluconf.Config) (http.Header, error) {
+	header := http.Header{}
+	for _, line := range conf.GetStrings("header") {
+		ss := strings.SplitN(line, ":", 2)
+		if name := strings.TrimSpace(ss[0]); len(ss) == 2 && name != "" {
+			header.Add(name, strings.TrimSpace(ss[1]))
+			continue
+		}
+		return nil, fmt.Errorf("illegal header: %s", line)
+	}
+	return header, nil
+}
+
+// httpRequest is the request of http probes
+type httpRequest struct {
+	method, host string
+	url          *url.URL
+	header       http.Header
+}
+
+func loadHTTPRequest(conf fluconf.Config, u *url.URL, host string) (*httpRequest, error) {
+	header, err := LoadHeader(conf)
+	if err != nil {
+		return nil, err
+	}
+	req := &httpRequest{method: strings.ToUpper(conf.GetString("method", "GET")), host: host, url: u, header: header}
+	if !httpMethodPattern.MatchString(req.method) {
+		return nil, fmt.Errorf("illegal method: %s", req.method)
+	}
+	if req.header.Get("User-Agent") == "" {
+		v := version.Get()
+		req.header.Set("User-Agent", fmt.Sprintf("kube-probe/%s.%s", v.Major, v.Minor))
+	}
+	return req, nil
+}
+
+// doHTTPProbe is DoHTTPProbe of kubernetes with expectations, and failures categorized in the message
+func doHTTPProbe(ctx context.Context, client *http.Client, probeReq *httpRequest, expect *httpExpect) (kprobe.Result, string) {
+	req, err := http.NewRequest(probeReq.method, probeReq.url.String(), nil)
+	if err != nil {
+		return kprobe.Failure, fmt.Sprintf("request: %v", err)
+	}
+	req.Header, req.Host = probeReq.header.Clone(), probeReq.host
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		var handshakeErr handshakeError
+		if errors.As(err, &handshakeErr) {
+			return kprobe.Failure, fmt.Sprintf("handshake: %v", handshakeErr.error)
+		}
+		return kprobe.Failure, fmt.Sprintf("connect: %v", err)
+	}
+	defer res.Body.Close()
+	if result := expect.status(res.StatusCode); result != kprobe.Success {
+		return result, fmt.Sprintf("status: %s", res.Status)
+	}
+	if !expect.matchBody() {
+		io.Copy(ioutil.Discard, res.Body)
+		return kprobe.Success, ""
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxHTTPBody))
+	if err != nil {
+		return kprobe.Failure, fmt.Sprintf("body: %v", err)
+	}
+	if message := expect.checkBody(body); message != "" {
+		return kprobe.Failure, message
+	}
+	return kprobe.Success, ""
+}
+
+// loadHTTPProbeFunc dials ip (defaults to host), and sends host as the Host header and the default sni if it differs
+func loadHTTPProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error) {
+	scheme := conf.GetString("scheme", conf["probe"])
+	defaultPort := map[string]int{"http": 80, "https": 443}[scheme]
+	if defaultPort == 0 {
+		return nil, "", fmt.Errorf("illegal scheme: %s", scheme)
+	}
+	host, port, uri := conf.GetString("host", "127.0.0.1"), conf.GetInt("port", defaultPort), conf.GetString("uri", "/")
+	ip, vhost := conf.GetString("ip", host), ""
+	if host != ip {
+		vhost = host
+	}
+	if port <= 0 {
+		return nil, "", fmt.Errorf("illegal port: %v", port)
+	}
+	u, err := url.Parse(fmt.Sprintf("%s://%s/", scheme, net.JoinHostPort(ip, strconv.Itoa(port))))
+	if err != nil {
+		return nil, "", fmt.Errorf("illegal host or port: %s, %d", ip, port)
+	}
+	u, err = u.Parse(uri)
+	if err != nil {
+		return nil, "", fmt.Errorf("illegal uri: %s", uri)
+	}
+	req, err := loadHTTPRequest(conf, u, vhost)
+	if err != nil {
+		return nil, "", err
+	}
+	expect, err := loadHTTPExpect(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+		Proxy:             http.ProxyURL(nil),
+	}
+	if scheme == "https" {
+		tlsConf := conf
+		if _, ok := conf["sni"]; !ok && vhost != "" {
+			tlsConf = conf.CopyWith("sni", vhost)
+		}
+		tlsConfig, err := LoadTLSConfig(tlsConf)
+		if err != nil {
+			return nil, "", err
+		}
+		transport.DialTLSContext = dialTLS(tlsConfig)
+	}
+	client := &http.Client{Transport: transport, CheckRedirect: redirectChecker}
+	name := fmt.Sprintf("http|%s", u)
+	if vhost != "" {
+		name = fmt.Sprintf("http|%s|%s", vhost, u)
+	}
+
+	return func(ctx context.Context, timeout time.Duration) (int, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		result, message := doHTTPProbe(ctx, client, req, expect)
+		SetProbeMessage(ctx, message)
+		return kprobeResultWeight(result, conf), nil
+	}, name, nil
+}
@@ -0,0 +1,147 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+func probeWithMessage(conf fluconf.Config) (int, string, error) {
+	probe, _, err := LoadSimpleStatusProbeFunc(conf)
+	if err != nil {
+		return 0, "", err
+	}
+	message := &probeMessage{}
+	status, err := probe(context.WithValue(context.Background(), probeMessageKey{}, message), time.Second)
+	return status, message.String(), err
+}
+
+func TestHTTPSProbe(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/mtls" && len(req.TLS.PeerCertificates) == 0:
+			res.WriteHeader(403)
+		case req.URL.Path == "/500":
+			res.WriteHeader(500)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert, MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	serverCert := ts.TLS.Certificates[0]
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Certificate[0]}))
+	keyDER, err := x509.MarshalPKCS8PrivateKey(serverCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	tests := []struct {
+		conf    fluconf.Config
+		want    int
+		message string
+	}{
+		{fluconf.Config{"probe": "https", "insecure": "yes"}, 1, ""},
+		{fluconf.Config{"probe": "http", "scheme": "https", "insecure": "yes", "uri": "/500"}, -1, "status: 500"},
+		{fluconf.Config{"probe": "https"}, -1, "handshake:"},
+		{fluconf.Config{"probe": "https", "ca-data": certPEM}, 1, ""},
+		{fluconf.Config{"probe": "https", "ca-data": certPEM, "sni": "example.com"}, 1, ""},
+		{fluconf.Config{"probe": "https", "ca-data": certPEM, "sni": "other.example.org"}, -1, "handshake:"},
+		{fluconf.Config{"probe": "https", "ca-data": certPEM, "ip": host, "host": "example.com"}, 1, ""},
+		{fluconf.Config{"probe": "https", "insecure": "yes", "min-tls-version": "1.3"}, -1, "handshake:"},
+		{fluconf.Config{"probe": "https", "insecure": "yes", "uri": "/mtls"}, -1, "status: 403"},
+		{fluconf.Config{"probe": "https", "insecure": "yes", "uri": "/mtls", "cert-data": certPEM, "key-data": keyPEM}, 1, ""},
+		{fluconf.Config{"probe": "https", "host": host, "port": "1", "insecure": "yes"}, -1, "connect:"},
+	}
+	for _, tt := range tests {
+		conf := fluconf.Config{"host": host, "port": port}.CopyWithAll(tt.conf)
+		got, message, err := probeWithMessage(conf)
+		if err != nil || got != tt.want || !strings.HasPrefix(message, tt.message) || (tt.message == "" && message != "") {
+			t.Errorf("probe %v = %v, %q, %v, want %v, %q", tt.conf, got, message, err, tt.want, tt.message)
+		}
+	}
+
+	for _, conf := range []fluconf.Config{
+		{"probe": "https", "ca-data": "garbage"},
+		{"probe": "https", "cert-data": certPEM},
+		{"probe": "https", "min-tls-version": "0.9"},
+		{"probe": "https", "ca": "/nonexistent/ca.crt"},
+		{"probe": "http", "scheme": "ftp"},
+	} {
+		if _, _, err := LoadSimpleStatusProbeFunc(conf); err == nil {
+			t.Errorf("LoadSimpleStatusProbeFunc(%v) succeeded", conf)
+		}
+	}
+}
+
+func TestHTTPProbeRequest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Host != "www.example.com" || req.Header.Get("X-Token") != "abc" || req.Header.Get("X-Trace") != "1" {
+			res.WriteHeader(400)
+			return
+		}
+		switch req.URL.Path {
+		case "/created":
+			res.WriteHeader(201)
+		case "/moved":
+			res.Header().Set("Location", "http://other.example.com/")
+			res.WriteHeader(302)
+		case "/method":
+			res.Write([]byte("method " + req.Method))
+		default:
+			res.Write([]byte(`{"status":"UP","version":"1.2.3"}`))
+		}
+	}))
+	defer ts.Close()
+	ip, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	base := fluconf.Config{"probe": "http", "ip": ip, "host": "www.example.com", "port": port, "header": "X-Token: abc\nX-Trace:1"}
+
+	tests := []struct {
+		conf    fluconf.Config
+		want    int
+		message string
+	}{
+		{fluconf.Config{}, 1, ""},
+		{fluconf.Config{"header": "X-Token: abc"}, -1, "status: 400"},
+		{fluconf.Config{"host": ip}, -1, "status: 400"},
+		{fluconf.Config{"uri": "/created", "expect-status": "200"}, -1, "status: 201"},
+		{fluconf.Config{"uri": "/created", "expect-status": "200,2xx"}, 1, ""},
+		{fluconf.Config{"uri": "/moved"}, -1, "status: 302"},
+		{fluconf.Config{"uri": "/moved", "expect-status": "3xx"}, 1, ""},
+		{fluconf.Config{"uri": "/moved", "warning": "0"}, 0, "status: 302"},
+		{fluconf.Config{"method": "post", "uri": "/method", "expect-body": "method POST"}, 1, ""},
+		{fluconf.Config{"expect-body": `"status":"UP"`}, 1, ""},
+		{fluconf.Config{"expect-body": `"status":"DOWN"`}, -1, `body: "\"status\":\"DOWN\"" not found`},
+		{fluconf.Config{"expect-body-regex": `"version":"1\.[0-9]+`}, 1, ""},
+		{fluconf.Config{"expect-body-regex": `"version":"2\.`}, -1, "body: /"},
+	}
+	for _, tt := range tests {
+		got, message, err := probeWithMessage(base.CopyWithAll(tt.conf))
+		if err != nil || got != tt.want || !strings.HasPrefix(message, tt.message) || (tt.message == "" && message != "") {
+			t.Errorf("probe %v = %v, %q, %v, want %v, %q", tt.conf, got, message, err, tt.want, tt.message)
+		}
+	}
+
+	for _, conf := range []fluconf.Config{
+		{"method": "GET /"},
+		{"header": "invalid"},
+		{"expect-status": "20"},
+		{"expect-status": "200,6xx"},
+		{"expect-body-regex": "("},
+	} {
+		if _, _, err := LoadSimpleStatusProbeFunc(base.CopyWithAll(conf)); err == nil {
+			t.Errorf("LoadSimpleStatusProbeFunc(%v) succeeded", conf)
+		}
+	}
+}
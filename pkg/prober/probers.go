@@ -3,13 +3,12 @@ package prober
 import (
 	"context"
 	"fmt"
-	"net/http"
-	"net/url"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
 	kprobe "k8s.io/kubernetes/pkg/probe"
-	httpprobe "k8s.io/kubernetes/pkg/probe/http"
 	tcpprobe "k8s.io/kubernetes/pkg/probe/tcp"
 )
 
@@ -65,31 +64,8 @@ func kprobeResultWeight(result kprobe.Result, conf fluconf.Config) int {
 	return conf.GetInt(string(result), DefaultSimpleStatusResult(result == kprobe.Success, true).StatusWeight())
 }
 
-func loadHTTPProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error) {
-	p, host, port, uri := httpprobe.New(false), conf.GetString("host", "127.0.0.1"), conf.GetInt("port", 80), conf.GetString("uri", "/")
-	if port <= 0 {
-		return nil, "", fmt.Errorf("illegal port: %v", port)
-	}
-	u, err := url.Parse(fmt.Sprintf("http://%s:%d/", host, port))
-	if err != nil {
-		return nil, "", fmt.Errorf("illegal host or port: %s, %d", host, port)
-	}
-	u, err = u.Parse(uri)
-	if err != nil {
-		return nil, "", fmt.Errorf("illegal uri: %s", uri)
-	}
-
-	return func(_ context.Context, timeout time.Duration) (int, error) {
-		status, _, err := p.Probe(u, http.Header{}, timeout)
-		if err != nil || status == kprobe.Unknown {
-			return kprobeResultWeight(kprobe.Unknown, conf), nil
-		}
-		return kprobeResultWeight(status, conf), nil
-	}, fmt.Sprintf("http|%s", u), nil
-}
-
 func loadTCPProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error) {
-	p, host, port := tcpprobe.New(), conf.GetString("host", "127.0.0.1"), conf.GetInt("port", 0)
+	p, host, port := tcpprobe.New(), conf.GetString("ip", conf.GetString("host", "127.0.0.1")), conf.GetInt("port", 0)
 	if port <= 0 {
 		return nil, "", fmt.Errorf("illegal port: %v", port)
 	}
@@ -104,8 +80,13 @@ func loadTCPProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error
 
 // SimpleStatusProbeFuncFactories var
 var SimpleStatusProbeFuncFactories = map[string]func(conf fluconf.Config) (SimpleStatusProbeFunc, string, error){
-	"http": loadHTTPProbeFunc,
-	"tcp":  loadTCPProbeFunc,
+	"http":  loadHTTPProbeFunc,
+	"https": loadHTTPProbeFunc,
+	"tcp":   loadTCPProbeFunc,
+	"exec":  loadExecProbeFunc,
+	"grpc":  loadGRPCProbeFunc,
+	"udp":   loadUDPProbeFunc,
+	"dns":   loadDNSProbeFunc,
 }
 
 // LoadSimpleStatusProbeFunc from config
@@ -135,6 +116,41 @@ func LoadSimpleStatusProbeFuncSafe(conf fluconf.Config) (SimpleStatusProbeFunc,
 // LoadSimpleStatusProber config
 func LoadSimpleStatusProber(conf fluconf.Config, updaters ...SimpleStatusUpdateFunc) StatusProber {
 	probe, name := LoadSimpleStatusProbeFuncSafe(conf)
+	return newSimpleStatusProber(conf, name, probe, updaters)
+}
+
+// LoadResolvedStatusProber loads a prober of conf resolved before every probe, eg. with secrets of references,
+// and reloaded when the resolved config changes; failures to resolve or load fail the probe with the error as message
+func LoadResolvedStatusProber(conf fluconf.Config, resolve func(fluconf.Config) (fluconf.Config, error), updaters ...SimpleStatusUpdateFunc) StatusProber {
+	_, name := LoadSimpleStatusProbeFuncSafe(conf)
+	var (
+		lock     sync.Mutex
+		resolved fluconf.Config
+		loaded   SimpleStatusProbeFunc
+		loadErr  error
+	)
+	probe := func(ctx context.Context, timeout time.Duration) (int, error) {
+		current, err := resolve(conf)
+		if err == nil {
+			lock.Lock()
+			if resolved == nil || !reflect.DeepEqual(current, resolved) {
+				resolved = current
+				loaded, _, loadErr = LoadSimpleStatusProbeFunc(current)
+			}
+			probe := loaded
+			err = loadErr
+			lock.Unlock()
+			if err == nil {
+				return probe(ctx, timeout)
+			}
+		}
+		SetProbeMessage(ctx, err.Error())
+		return kprobeResultWeight(kprobe.Failure, conf), nil
+	}
+	return newSimpleStatusProber(conf, name, probe, updaters)
+}
+
+func newSimpleStatusProber(conf fluconf.Config, name string, probe SimpleStatusProbeFunc, updaters []SimpleStatusUpdateFunc) StatusProber {
 	prober := NewSimpleStatusProber(name, []SimpleStatusProbeFunc{probe}, updaters)
 	prober.SetInterval(conf.GetDuration("interval", prober.Interval()))
 	prober.SetTimeout(conf.GetDuration("timeout", prober.Timeout()))
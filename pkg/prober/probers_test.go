@@ -1,6 +1,7 @@
 package prober
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -52,3 +53,66 @@ func TestProbers(t *testing.T) {
 		}
 	})
 }
+
+func TestExecProbe(t *testing.T) {
+	tests := []struct {
+		conf    fluconf.Config
+		want    int
+		message string
+	}{
+		{fluconf.Config{"probe": "exec", "command": "echo ok"}, 1, "ok\n"},
+		{fluconf.Config{"probe": "exec", "command": "echo failed >&2; exit 2"}, -1, "failed\n"},
+		{fluconf.Config{"probe": "exec", "command": `test "$HOST:$PORT:$MAX_OUTPUT" = "10.0.0.1:80:4"`, "host": "10.0.0.1", "port": "80", "max-output": "4"}, 1, ""},
+		{fluconf.Config{"probe": "exec", "command": "echo 123456", "max-output": "4"}, 1, "1234...(truncated)"},
+		{fluconf.Config{"probe": "exec", "command": "exit 1", "failure": "-3"}, -3, ""},
+		{fluconf.Config{"probe": "exec", "command": "sleep 10 & sleep 10"}, -1, "context deadline exceeded:"},
+		{fluconf.Config{"probe": "exec", "command": "setsid sleep 10 & echo started; sleep 10"}, -1, "context deadline exceeded: started"},
+	}
+	for _, tt := range tests {
+		probe, _, err := LoadSimpleStatusProbeFunc(tt.conf)
+		if err != nil {
+			t.Fatalf("LoadSimpleStatusProbeFunc(%v): %v", tt.conf, err)
+		}
+		message := &probeMessage{}
+		start := time.Now()
+		got, err := probe(context.WithValue(context.Background(), probeMessageKey{}, message), 200*time.Millisecond)
+		if err != nil || got != tt.want || message.String() != tt.message {
+			t.Errorf("exec %q = %v, %v, %q, want %v, %q", tt.conf["command"], got, err, message.String(), tt.want, tt.message)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("exec %q took %v", tt.conf["command"], elapsed)
+		}
+	}
+	if _, _, err := LoadSimpleStatusProbeFunc(fluconf.Config{"probe": "exec"}); err == nil {
+		t.Errorf("LoadSimpleStatusProbeFunc() without command succeeded")
+	}
+}
+
+func TestLoadResolvedStatusProber(t *testing.T) {
+	var resolved fluconf.Config
+	var resolveErr error
+	prober := LoadResolvedStatusProber(fluconf.Config{"probe": "exec", "command": "exit 1"}, func(conf fluconf.Config) (fluconf.Config, error) {
+		return resolved, resolveErr
+	})
+	for _, tt := range []struct {
+		resolved fluconf.Config
+		err      error
+		want     int
+		message  string
+	}{
+		{nil, fmt.Errorf("secret not found"), -1, "secret not found"},
+		{fluconf.Config{"probe": "exec", "command": "echo ok"}, nil, 1, "ok\n"},
+		{fluconf.Config{"probe": "exec", "command": "echo rotated; exit 1"}, nil, -1, "rotated\n"},
+		{fluconf.Config{"probe": "exec"}, nil, -1, "illegal command: \"\""},
+	} {
+		resolved, resolveErr = tt.resolved, tt.err
+		message := &probeMessage{}
+		status, err := prober.ProbeStatus(context.WithValue(context.Background(), probeMessageKey{}, message), time.Second)
+		if err != nil || status.(SimpleStatusResult).StatusWeight() != tt.want || message.String() != tt.message {
+			t.Errorf("probe of %v, %v = %v, %v, %q, want %v, %q", tt.resolved, tt.err, status, err, message.String(), tt.want, tt.message)
+		}
+	}
+	if name := prober.Name(); name == "" {
+		t.Errorf("Name() of a resolved prober is empty")
+	}
+}
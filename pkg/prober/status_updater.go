@@ -19,7 +19,45 @@ type StatusUpdater interface {
 	Start(key interface{}, prober StatusProber) (loaded bool, stop func())
 	Stop(key interface{}) bool
 	Status(key interface{}) (status interface{}, ok bool)
+	Stats(key interface{}) (stats ProbeStats, ok bool)
 	Get(key interface{}) (prober StatusProber, ok bool)
+	SetObserver(observer ProbeObserver)
+}
+
+// ProbeObserver is called after every probe
+type ProbeObserver func(key interface{}, status interface{}, err error, duration time.Duration)
+
+// ProbeStats type
+type ProbeStats struct {
+	LastProbe      time.Time
+	LastStatus     interface{}
+	LastError      error
+	Successes      int
+	Failures       int
+	LastTransition time.Time
+	LastMessage    string
+}
+
+type probeMessageKey struct{}
+
+type probeMessage struct {
+	sync.Mutex
+	message string
+}
+
+func (m *probeMessage) String() string {
+	m.Lock()
+	defer m.Unlock()
+	return m.message
+}
+
+// SetProbeMessage attaches a diagnostic message, eg. command output, to the running probe
+func SetProbeMessage(ctx context.Context, message string) {
+	if m, ok := ctx.Value(probeMessageKey{}).(*probeMessage); ok {
+		m.Lock()
+		defer m.Unlock()
+		m.message = message
+	}
 }
 
 // StatusWeight interface
@@ -45,6 +83,11 @@ type StatusProber interface {
 	SetRiseCount(val int) StatusProber
 }
 
+// StatusWatcher interface, probers implementing it are also probed on changes notified until ctx is done
+type StatusWatcher interface {
+	Watch(ctx context.Context) <-chan struct{}
+}
+
 // ProbeStatusFunc type
 type ProbeStatusFunc func(context.Context, time.Duration) (interface{}, error)
 
@@ -164,8 +207,9 @@ func NewStatusProber(name string, probeStatus ProbeStatusFunc, updateStatus Upda
 
 type statusUpdater struct {
 	sync.Map
-	ctx    context.Context
-	logger *log.Logger
+	ctx      context.Context
+	logger   *log.Logger
+	observer atomic.Value
 }
 
 // NewStatusUpdater func
@@ -188,13 +232,54 @@ type statusRecord struct {
 	closed        chan struct{}
 	status        atomic.Value
 	statuesStored int32
+	stats         atomic.Value
 }
 
 func (record *statusRecord) Prober() StatusProber {
 	return record.Load().(StatusProber)
 }
 
+func statusSign(status interface{}) int {
+	if weight, ok := status.(StatusWeight); ok {
+		switch w := weight.StatusWeight(); {
+		case w > 0:
+			return 1
+		case w < 0:
+			return -1
+		}
+	}
+	return 0
+}
+
+func (record *statusRecord) LoadStats() ProbeStats {
+	if stats, ok := record.stats.Load().(ProbeStats); ok {
+		return stats
+	}
+	return ProbeStats{}
+}
+
+func (record *statusRecord) probed(status interface{}, err error, duration time.Duration, message string) {
+	if observer, ok := record.u.observer.Load().(ProbeObserver); ok && observer != nil {
+		observer(record.key, status, err, duration)
+	}
+	stats := record.LoadStats()
+	stats.LastProbe, stats.LastStatus, stats.LastError, stats.LastMessage = time.Now(), status, err, message
+	switch sign := statusSign(status); {
+	case err != nil:
+	case sign > 0:
+		stats.Successes, stats.Failures = stats.Successes+1, 0
+	case sign < 0:
+		stats.Successes, stats.Failures = 0, stats.Failures+1
+	}
+	record.stats.Store(stats)
+}
+
 func (record *statusRecord) StoreStatus(status interface{}) (abort bool) {
+	if last, lastOK := record.LoadStatus(); !lastOK || statusSign(last) != statusSign(status) {
+		stats := record.LoadStats()
+		stats.LastTransition = time.Now()
+		record.stats.Store(stats)
+	}
 	if err := record.Prober().UpdateStatus(status); err != nil {
 		if err == ErrorAbort {
 			return true
@@ -242,8 +327,11 @@ func (u *statusUpdater) Start(key interface{}, prober StatusProber) (loaded bool
 				close(record.closed)
 				stop()
 			}()
-			success, failure, timer := 0, 0, time.NewTimer(time.Millisecond)
+			success, failure, timer, watched := 0, 0, time.NewTimer(time.Millisecond), (<-chan struct{})(nil)
 			defer timer.Stop()
+			if watcher, ok := prober.(StatusWatcher); ok {
+				watched = watcher.Watch(record.ctx)
+			}
 			doProbe := func() (status interface{}, statusOK bool, abort bool) {
 				prober := record.Prober()
 				if interval := prober.Interval(); interval > 0 {
@@ -251,12 +339,18 @@ func (u *statusUpdater) Start(key interface{}, prober StatusProber) (loaded bool
 				} else {
 					abort = true
 				}
-				ctx, cancel := u.ctx, context.CancelFunc(nil)
+				// probes are cancelled once stopped, eg. long polls of sources
+				ctx, cancel := record.ctx, context.CancelFunc(nil)
 				if timeout := prober.Timeout(); timeout > 0 {
-					ctx, cancel = context.WithTimeout(u.ctx, prober.Timeout())
+					ctx, cancel = context.WithTimeout(record.ctx, prober.Timeout())
 					defer cancel()
 				}
-				status, err := prober.ProbeStatus(ctx, prober.Timeout())
+				start, message := time.Now(), &probeMessage{}
+				status, err := prober.ProbeStatus(context.WithValue(ctx, probeMessageKey{}, message), prober.Timeout())
+				if record.ctx.Err() != nil {
+					return nil, false, true
+				}
+				record.probed(status, err, time.Since(start), message.String())
 				if glog.V(2) || (err != nil && err != ErrorStatusUnknown) {
 					record.u.logger.Printf("probe (%v): status=%v, err=%v", prober, status, err)
 				}
@@ -282,6 +376,8 @@ func (u *statusUpdater) Start(key interface{}, prober StatusProber) (loaded bool
 				select {
 				case <-record.ctx.Done():
 					return
+				case <-watched:
+					timer.Reset(0)
 				case <-timer.C:
 					status, statusOK := record.LoadStatus()
 					probeStatus, probeOK, abort := doProbe()
@@ -310,6 +406,17 @@ func (u *statusUpdater) Status(key interface{}) (status interface{}, ok bool) {
 	return false, false
 }
 
+func (u *statusUpdater) Stats(key interface{}) (stats ProbeStats, ok bool) {
+	if val, loaded := u.Load(key); loaded {
+		return val.(*statusRecord).LoadStats(), true
+	}
+	return ProbeStats{}, false
+}
+
+func (u *statusUpdater) SetObserver(observer ProbeObserver) {
+	u.observer.Store(observer)
+}
+
 func (u *statusUpdater) Get(key interface{}) (prober StatusProber, ok bool) {
 	if val, loaded := u.Load(key); loaded {
 		return val.(*statusRecord).Prober(), true
@@ -335,6 +442,11 @@ func UpdaterStatus(key interface{}) (status interface{}, ok bool) {
 	return DefaultStatusUpdater.Status(key)
 }
 
+// UpdaterStats func
+func UpdaterStats(key interface{}) (stats ProbeStats, ok bool) {
+	return DefaultStatusUpdater.Stats(key)
+}
+
 // UpdaterGet func
 func UpdaterGet(key interface{}) (prober StatusProber, ok bool) {
 	return DefaultStatusUpdater.Get(key)
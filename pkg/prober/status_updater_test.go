@@ -3,6 +3,7 @@ package prober
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -126,3 +127,60 @@ func TestHeathCheckOnce(t *testing.T) {
 		t.Errorf("status5: %v, %v", status, statusOK)
 	}
 }
+
+func TestHeathCheckStats(t *testing.T) {
+	check := NewStatusProber(t.Name(), testProbeStatusFunc(probeSuccess, probeSuccess,
+		probeFailure, probeFailure, probeFailure, probeFailure, probeFailure, probeFailure, probeFailure, probeFailure), nil).
+		SetInterval(10 * time.Millisecond).SetTimeout(time.Millisecond).SetRiseCount(1).SetFallCount(1)
+	StartUpdater(t.Name(), check)
+	defer StopUpdater(t.Name())
+	time.Sleep(15 * time.Millisecond)
+	stats, statsOK := UpdaterStats(t.Name())
+	if !statsOK || stats.Successes != 2 || stats.Failures != 0 || stats.LastTransition.IsZero() {
+		t.Errorf("stats1: %+v, %v", stats, statsOK)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if stats, statsOK = UpdaterStats(t.Name()); !statsOK || stats.Successes != 0 || stats.Failures < 2 {
+		t.Errorf("stats2: %+v, %v", stats, statsOK)
+	}
+}
+
+func TestHeathCheckObserver(t *testing.T) {
+	updater, observed := NewStatusUpdater(context.TODO(), nil), int32(0)
+	updater.SetObserver(func(key interface{}, status interface{}, err error, duration time.Duration) {
+		if key == t.Name() && err == nil && duration >= 0 {
+			atomic.AddInt32(&observed, 1)
+		}
+	})
+	_, stop := updater.Start(t.Name(), NewStatusProber(t.Name(), testProbeStatusFunc(probeSuccess), nil).
+		SetInterval(time.Millisecond).SetTimeout(time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if atomic.LoadInt32(&observed) == 0 {
+		t.Errorf("observer not called")
+	}
+}
+
+type testWatcher struct {
+	StatusProber
+	changes chan struct{}
+}
+
+func (w testWatcher) Watch(ctx context.Context) <-chan struct{} {
+	return w.changes
+}
+
+func TestHeathCheckWatcher(t *testing.T) {
+	probed := int32(0)
+	check := testWatcher{NewStatusProber(t.Name(), func(context.Context, time.Duration) (interface{}, error) {
+		return testStatus(atomic.AddInt32(&probed, 1) > 0), nil
+	}, nil).SetInterval(time.Hour), make(chan struct{})}
+	StartUpdater(t.Name(), check)
+	defer StopUpdater(t.Name())
+	time.Sleep(20 * time.Millisecond)
+	check.changes <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&probed); got != 2 {
+		t.Errorf("probed %v times, want 2", got)
+	}
+}
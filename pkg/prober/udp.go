@@ -0,0 +1,91 @@
+package prober
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+	kprobe "k8s.io/kubernetes/pkg/probe"
+)
+
+// loadUDPPayload reads send= as text, or send-hex= as hex
+func loadUDPPayload(conf fluconf.Config) ([]byte, error) {
+	if data, ok := conf["send-hex"]; ok {
+		payload, err := hex.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("illegal send-hex: %v", err)
+		}
+		return payload, nil
+	}
+	return []byte(conf["send"]), nil
+}
+
+// loadUDPProbeFunc sends the payload, and expects a response matching expect= regex if given,
+// or no error (eg. ICMP port unreachable) before timeout if expect-response=no
+func loadUDPProbeFunc(conf fluconf.Config) (SimpleStatusProbeFunc, string, error) {
+	ip, port := conf.GetString("ip", conf.GetString("host", "127.0.0.1")), conf.GetInt("port", 0)
+	if port <= 0 {
+		return nil, "", fmt.Errorf("illegal port: %v", port)
+	}
+	payload, err := loadUDPPayload(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	var expect *regexp.Regexp
+	if pattern, ok := conf["expect"]; ok {
+		if expect, err = regexp.Compile(pattern); err != nil {
+			return nil, "", fmt.Errorf("illegal expect: %v", err)
+		}
+	}
+	addr, expectResponse := net.JoinHostPort(ip, strconv.Itoa(port)), conf.GetBool("expect-response", true)
+
+	return func(ctx context.Context, timeout time.Duration) (int, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		result, message := doUDPProbe(ctx, addr, payload, expect, expectResponse)
+		SetProbeMessage(ctx, message)
+		return kprobeResultWeight(result, conf), nil
+	}, fmt.Sprintf("udp|%s", addr), nil
+}
+
+func doUDPProbe(ctx context.Context, addr string, payload []byte, expect *regexp.Regexp, expectResponse bool) (kprobe.Result, string) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", addr)
+	if err != nil {
+		return kprobe.Failure, fmt.Sprintf("connect: %v", err)
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(payload); err != nil {
+		return kprobe.Failure, fmt.Sprintf("send: %v", err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	switch netErr, _ := err.(net.Error); {
+	case err != nil && !expectResponse && netErr != nil && netErr.Timeout():
+		return kprobe.Success, ""
+	case err != nil:
+		return kprobe.Failure, fmt.Sprintf("receive: %v", err)
+	case expect != nil && !expect.Match(buf[:n]):
+		return kprobe.Failure, fmt.Sprintf("response: /%s/ not matched: %q", expect, truncate(buf[:n], 64))
+	}
+	return kprobe.Success, ""
+}
+
+func truncate(data []byte, size int) []byte {
+	if len(data) > size {
+		return data[:size]
+	}
+	return data
+}
@@ -0,0 +1,66 @@
+package prober
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/xiaopal/kube-service-importer/pkg/fluconf"
+)
+
+func TestUDPProbe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) != "drop" {
+				conn.WriteTo(append([]byte("pong:"), buf[:n]...), addr)
+			}
+		}
+	}()
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	ip, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	_, closedPort, _ := net.SplitHostPort(closed.LocalAddr().String())
+
+	tests := []struct {
+		conf    fluconf.Config
+		want    int
+		message string
+	}{
+		{fluconf.Config{"send": "ping"}, 1, ""},
+		{fluconf.Config{"send-hex": "7069", "expect": "^pong:pi$"}, 1, ""},
+		{fluconf.Config{"send": "ping", "expect": "^PONG"}, -1, "response: /^PONG/ not matched"},
+		{fluconf.Config{"send": "drop"}, -1, "receive:"},
+		{fluconf.Config{"send": "drop", "expect-response": "no"}, 1, ""},
+		{fluconf.Config{"send": "ping", "port": closedPort}, -1, "receive:"},
+	}
+	for _, tt := range tests {
+		conf := fluconf.Config{"probe": "udp", "ip": ip, "port": port}.CopyWithAll(tt.conf)
+		got, message, err := probeWithMessage(conf)
+		if err != nil || got != tt.want || !strings.HasPrefix(message, tt.message) || (tt.message == "" && message != "") {
+			t.Errorf("probe %v = %v, %q, %v, want %v, %q", tt.conf, got, message, err, tt.want, tt.message)
+		}
+	}
+
+	for _, conf := range []fluconf.Config{
+		{"probe": "udp"},
+		{"probe": "udp", "port": "53", "send-hex": "xyz"},
+		{"probe": "udp", "port": "53", "expect": "("},
+	} {
+		if _, _, err := LoadSimpleStatusProbeFunc(conf); err == nil {
+			t.Errorf("LoadSimpleStatusProbeFunc(%v) succeeded", conf)
+		}
+	}
+}